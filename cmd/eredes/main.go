@@ -0,0 +1,221 @@
+// Command eredes shows the state of a running eredes plugin, read from its
+// health endpoint.
+//
+// Usage:
+//
+//	eredes watch [-address localhost:9790] [-token TOKEN] [-refresh 5s]
+//	eredes healthcheck [-address localhost:9790] [-token TOKEN]
+//	eredes migrate-parser [-config /etc/telegraf/telegraf.conf]
+//
+// healthcheck exits with status 1 if the plugin is unhealthy or unreachable,
+// for Docker HEALTHCHECK. The address and token default to the
+// EREDES_HEALTH_ADDRESS and EREDES_HEALTH_TOKEN environment variables.
+//
+// migrate-parser prints the built-in decoder settings equivalent to the
+// json or json_v2 parser settings of the [[inputs.eredes]] sections.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fields of the health endpoint response shown by watch
+type health struct {
+	State       string    `json:"state"`
+	StateSince  time.Time `json:"state_since"`
+	LastGather  time.Time `json:"last_gather"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error"`
+	LastReading time.Time `json:"last_reading"`
+	Healthy     bool      `json:"healthy"`
+	LagSeconds  float64   `json:"lag_seconds"`
+	NextGather  time.Time `json:"next_gather"`
+
+	DailyTotals []struct {
+		Cpe   string  `json:"cpe"`
+		Date  string  `json:"date"`
+		Total float64 `json:"total"`
+	} `json:"daily_totals"`
+}
+
+const usage = `usage:
+  eredes watch [-address localhost:9790] [-token TOKEN] [-refresh 5s]
+  eredes healthcheck [-address localhost:9790] [-token TOKEN]
+  eredes migrate-parser [-config /etc/telegraf/telegraf.conf]`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	address := flags.String("address", env("EREDES_HEALTH_ADDRESS", "localhost:9790"), "health_address of the plugin")
+	token := flags.String("token", env("EREDES_HEALTH_TOKEN", ""), "health_token, if the endpoint requires one")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	switch os.Args[1] {
+	case "watch":
+		refresh := flags.Duration("refresh", 5*time.Second, "time between refreshes")
+		flags.Parse(os.Args[2:])
+
+		url := healthURL(*address)
+		for {
+			h, err := fetch(client, url, *token)
+			render(os.Stdout, url, h, err)
+			time.Sleep(*refresh)
+		}
+	case "healthcheck":
+		flags.Parse(os.Args[2:])
+
+		h, err := fetch(client, healthURL(*address), *token)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unreachable: %s\n", err)
+			os.Exit(1)
+		}
+		if !h.Healthy {
+			fmt.Fprintf(os.Stderr, "unhealthy: state %s, last error: %s\n", h.State, h.LastError)
+			os.Exit(1)
+		}
+		fmt.Printf("healthy: state %s\n", h.State)
+	case "migrate-parser":
+		config := flags.String("config", "/etc/telegraf/telegraf.conf", "telegraf.conf with the [[inputs.eredes]] sections")
+		flags.Parse(os.Args[2:])
+
+		f, err := os.Open(*config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		if err := migrateParser(f, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func healthURL(address string) string {
+	url := address
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	return strings.TrimSuffix(url, "/") + "/health"
+}
+
+func env(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Read the health endpoint. Unhealthy is reported with status 503 and the
+// same body, so it isn't an error.
+func fetch(client *http.Client, url string, token string) (*health, error) {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, fmt.Errorf("received status code %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var h health
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func render(w io.Writer, url string, h *health, err error) {
+	// Clear the screen and move to the top left
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "eredes %s  %s\n\n", url, time.Now().Format("2006-01-02 15:04:05"))
+
+	if err != nil {
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+
+	healthy := "yes"
+	if !h.Healthy {
+		healthy = "NO"
+	}
+	fmt.Fprintf(w, "State:         %s (since %s)\n", h.State, ago(h.StateSince))
+	fmt.Fprintf(w, "Healthy:       %s\n", healthy)
+	fmt.Fprintf(w, "Last fetch:    %s\n", ago(h.LastGather))
+	fmt.Fprintf(w, "Last success:  %s\n", ago(h.LastSuccess))
+	if h.LastError != "" {
+		fmt.Fprintf(w, "Last error:    %s\n", h.LastError)
+	}
+	fmt.Fprintf(w, "Last reading:  %s (lag %s)\n", ago(h.LastReading), time.Duration(h.LagSeconds*float64(time.Second)).Round(time.Minute))
+	fmt.Fprintf(w, "Next fetch:    %s\n\n", until(h.NextGather))
+
+	// Readings are published the day after, so the newest days are
+	// usually yesterday and the day before
+	today := time.Now().Format("2006-01-02")
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+
+	totals := make(map[string]map[string]float64)
+	for _, total := range h.DailyTotals {
+		if total.Date != today && total.Date != yesterday {
+			continue
+		}
+		if totals[total.Cpe] == nil {
+			totals[total.Cpe] = make(map[string]float64)
+		}
+		totals[total.Cpe][total.Date] = total.Total
+	}
+
+	var cpes []string
+	for cpe := range totals {
+		cpes = append(cpes, cpe)
+	}
+	sort.Strings(cpes)
+
+	fmt.Fprintf(w, "%-24s %12s %12s\n", "CPE", "Today kWh", "Yesterday kWh")
+	for _, cpe := range cpes {
+		fmt.Fprintf(w, "%-24s %12.3f %12.3f\n", cpe, totals[cpe][today], totals[cpe][yesterday])
+	}
+}
+
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04:05") + " (" + time.Since(t).Round(time.Second).String() + " ago)"
+}
+
+func until(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	if time.Now().After(t) {
+		return "next interval"
+	}
+	return t.Format("2006-01-02 15:04:05") + " (in " + time.Until(t).Round(time.Second).String() + ")"
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Keys of the reading time the built-in decoder reads
+var builtinTimeKeys = []string{"loadCurveTimestamp", "date"}
+
+// Key of the reading value the built-in decoder reads, emitted as kwh
+const builtinValueKey = "meterLoadCurve"
+
+// Parser settings of an [[inputs.eredes]] section
+type parserSection struct {
+	line       int
+	dataFormat string
+
+	// json
+	jsonQuery    string
+	jsonTimeKey  string
+	stringFields []string
+	tagKeys      []string
+
+	// json_v2, one per [[inputs.eredes.json_v2.object]]
+	objects []*jsonV2Object
+}
+
+type jsonV2Object struct {
+	path         string
+	timestampKey string
+	fields       []string
+	tags         []string
+}
+
+// Read the parser settings of the [[inputs.eredes]] sections of a
+// telegraf.conf. Only the keys the conversion needs are read, the rest of
+// the TOML is skipped.
+func readParserSections(r io.Reader) ([]*parserSection, error) {
+	var sections []*parserSection
+	var section *parserSection
+	var table string
+
+	scanner := bufio.NewScanner(r)
+	number := 0
+	for scanner.Scan() {
+		number++
+		line := stripComment(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			table = strings.Trim(line, "[] ")
+			switch {
+			case table == "inputs.eredes":
+				section = &parserSection{line: number}
+				sections = append(sections, section)
+			case section != nil && table == "inputs.eredes.json_v2.object":
+				section.objects = append(section.objects, &jsonV2Object{})
+			case !strings.HasPrefix(table, "inputs.eredes."):
+				section = nil
+			}
+			continue
+		}
+		if section == nil {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		// Arrays may span several lines
+		for strings.HasPrefix(value, "[") && !strings.HasSuffix(value, "]") && scanner.Scan() {
+			number++
+			value += stripComment(scanner.Text())
+		}
+
+		var object *jsonV2Object
+		if len(section.objects) > 0 {
+			object = section.objects[len(section.objects)-1]
+		}
+
+		var err error
+		switch {
+		case table == "inputs.eredes" && key == "data_format":
+			section.dataFormat, err = tomlString(value)
+		case table == "inputs.eredes" && key == "json_query":
+			section.jsonQuery, err = tomlString(value)
+		case table == "inputs.eredes" && key == "json_time_key":
+			section.jsonTimeKey, err = tomlString(value)
+		case table == "inputs.eredes" && key == "json_string_fields":
+			section.stringFields, err = tomlStrings(value)
+		case table == "inputs.eredes" && key == "tag_keys":
+			section.tagKeys, err = tomlStrings(value)
+		case table == "inputs.eredes.json_v2.object" && key == "path":
+			object.path, err = tomlString(value)
+		case table == "inputs.eredes.json_v2.object" && key == "timestamp_key":
+			object.timestampKey, err = tomlString(value)
+		case table == "inputs.eredes.json_v2.object" && key == "included_keys":
+			object.fields, err = tomlStrings(value)
+		case table == "inputs.eredes.json_v2.object" && key == "tags":
+			object.tags, err = tomlStrings(value)
+		case table == "inputs.eredes.json_v2.object.field" && key == "path" && object != nil:
+			var field string
+			field, err = tomlString(value)
+			object.fields = append(object.fields, field)
+		case table == "inputs.eredes.json_v2.object.tag" && key == "path" && object != nil:
+			var tag string
+			tag, err = tomlString(value)
+			object.tags = append(object.tags, tag)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %s", number, key, err)
+		}
+	}
+	return sections, scanner.Err()
+}
+
+// Write the built-in decoder settings equivalent to the parser settings of
+// each section, with the keys to remove. What can't be mapped is reported
+// as a comment.
+func migrateParser(r io.Reader, w io.Writer) error {
+	sections, err := readParserSections(r)
+	if err != nil {
+		return err
+	}
+	if len(sections) == 0 {
+		return fmt.Errorf("no [[inputs.eredes]] section found")
+	}
+
+	for i, section := range sections {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "# [[inputs.eredes]] at line %d\n", section.line)
+
+		var path, timeKey string
+		var keys []string
+		switch section.dataFormat {
+		case "":
+			fmt.Fprintln(w, "# already using the built-in decoder, nothing to do")
+			continue
+		case "json":
+			fmt.Fprintln(w, "# remove data_format, json_query, json_time_key, json_time_format, json_string_fields and tag_keys")
+			path, timeKey = section.jsonQuery, section.jsonTimeKey
+			keys = append(append(keys, section.stringFields...), section.tagKeys...)
+		case "json_v2":
+			if len(section.objects) == 0 {
+				fmt.Fprintln(w, "# no [[inputs.eredes.json_v2.object]], only objects can be converted")
+				continue
+			}
+			if len(section.objects) > 1 {
+				fmt.Fprintln(w, "# the built-in decoder reads one array of readings, only the first object is converted")
+			}
+			fmt.Fprintln(w, "# remove data_format and the [[inputs.eredes.json_v2]] tables")
+			object := section.objects[0]
+			path, timeKey = object.path, object.timestampKey
+			keys = append(append(keys, object.fields...), object.tags...)
+		default:
+			fmt.Fprintf(w, "# data_format %q can't be converted, only json and json_v2\n", section.dataFormat)
+			continue
+		}
+
+		if timeKey != "" && !contains(builtinTimeKeys, timeKey) {
+			fmt.Fprintf(w, "# the time is read from %s, %q can't be mapped\n", strings.Join(builtinTimeKeys, " or "), timeKey)
+		}
+		fmt.Fprintf(w, "data_json_path = %s\n", strconv.Quote(path))
+
+		var phases, unmapped []string
+		value := false
+		for _, key := range keys {
+			lower := strings.ToLower(key)
+			switch {
+			case key == builtinValueKey:
+				value = true
+			case contains(builtinTimeKeys, key):
+			case strings.Contains(lower, "quality"):
+				fmt.Fprintf(w, "quality_key = %s\n", strconv.Quote(key))
+			case strings.Contains(lower, "source"):
+				fmt.Fprintf(w, "source_key = %s\n", strconv.Quote(key))
+			case strings.HasSuffix(lower, "l1") || strings.HasSuffix(lower, "l2") || strings.HasSuffix(lower, "l3"):
+				phases = append(phases, strconv.Quote(key))
+			default:
+				unmapped = append(unmapped, key)
+			}
+		}
+		if len(phases) > 0 {
+			fmt.Fprintf(w, "phase_keys = [%s]\n", strings.Join(phases, ", "))
+		}
+		for _, key := range unmapped {
+			fmt.Fprintf(w, "# %q can't be mapped, the built-in decoder only reads the reading value, time, quality, source and phases\n", key)
+		}
+		if value {
+			fmt.Fprintf(w, "# the value is emitted as a kwh float, to keep the %s field name:\n", builtinValueKey)
+			fmt.Fprintln(w, "# [inputs.eredes.field_rename]")
+			fmt.Fprintf(w, "#   kwh = %s\n", strconv.Quote(builtinValueKey))
+		} else {
+			fmt.Fprintf(w, "# the value is read from %s, which the parser didn't read\n", builtinValueKey)
+		}
+	}
+	return nil
+}
+
+// Line without its comment and surrounding spaces
+func stripComment(line string) string {
+	quote := rune(0)
+	for i, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+func tomlString(value string) (string, error) {
+	if strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) >= 2 {
+		return value[1 : len(value)-1], nil
+	}
+	return strconv.Unquote(value)
+}
+
+func tomlStrings(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") || !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("expected an array")
+	}
+
+	var values []string
+	for _, item := range strings.Split(strings.Trim(value, "[]"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s, err := tomlString(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package eredes
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Days of readings and totals kept behind the newest one of a CPE, for the
+// weeks spanning several windows
+const aggregateDays = 14
+
+// Consumption of a day and number of readings, kept in the state file
+type dayTotal struct {
+	Kwh    float64 `json:"kwh"`
+	Points int     `json:"points"`
+}
+
+// Consumption curve per CPE and day, to emit the daily and weekly totals
+type aggregates struct {
+	sync.Mutex
+	// Reading values per day and timestamp, like the snapshot
+	days map[dayKey]map[int64]float64
+}
+
+// Emit the daily and weekly totals and the daily peak of the days of the
+// readings, computed from the quarter-hour consumption curve. Weeks start on
+// Monday and are emitted once all their days are known. The daily totals are
+// kept in the state file, so a week spanning a restart is still complete.
+func (eredes *EREDES) addAggregates(acc telegraf.Accumulator, cpe string, readings []Reading) {
+	if (!eredes.Aggregates && !eredes.DailyPeak) || eredes.ReadingType != "quarter_hourly" {
+		return
+	}
+
+	a := &eredes.aggregates
+	a.Lock()
+	defer a.Unlock()
+
+	if a.days == nil {
+		a.days = make(map[dayKey]map[int64]float64)
+	}
+
+	dates := make(map[string]bool)
+	newest := ""
+	for _, r := range readings {
+		if r.Direction != "" && r.Direction != "consumption" {
+			continue
+		}
+		key := dayKey{cpe: cpe, date: r.Time.In(eredes.location).Format("2006-01-02")}
+		if a.days[key] == nil {
+			a.days[key] = make(map[int64]float64)
+		}
+		a.days[key][r.Time.Unix()] = r.Kwh
+		dates[key.date] = true
+		if key.date > newest {
+			newest = key.date
+		}
+	}
+	if len(dates) == 0 {
+		return
+	}
+
+	totals := make(map[string]dayTotal)
+	weeks := make(map[time.Time]bool)
+	for date := range dates {
+		day, err := time.ParseInLocation("2006-01-02", date, eredes.location)
+		if err != nil {
+			continue
+		}
+
+		if eredes.DailyPeak {
+			peak, at := a.peak(cpe, date)
+			acc.AddFields("eredes_daily_peak", map[string]interface{}{
+				"peak_kw": averagePower(peak, 1),
+				"peak_at": at.Unix(),
+			}, eredes.cpeTags(cpe), day)
+		}
+		if !eredes.Aggregates {
+			continue
+		}
+
+		kwh, points := a.total(cpe, date)
+		totals[date] = dayTotal{Kwh: kwh, Points: points}
+		acc.AddFields("eredes_daily_aggregate", map[string]interface{}{
+			"kwh":          kwh,
+			"avg_power_kw": averagePower(kwh, points),
+			"points":       points,
+		}, eredes.cpeTags(cpe), day)
+
+		// Back to Monday
+		weeks[day.AddDate(0, 0, -(int(day.Weekday())+6)%7)] = true
+	}
+
+	newestDay, err := time.Parse("2006-01-02", newest)
+	if err != nil {
+		return
+	}
+	oldest := newestDay.AddDate(0, 0, -aggregateDays).Format("2006-01-02")
+
+	if len(totals) > 0 {
+		if err := eredes.state.setDayTotals(cpe, totals, oldest, eredes.StateFile); err != nil {
+			log.Printf("[eredes] error saving state: %s", err)
+		}
+	}
+	known := eredes.state.dayTotals(cpe)
+
+	var starts []time.Time
+	for start := range weeks {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	for _, start := range starts {
+		var kwh float64
+		var points, days int
+		for i := 0; i < 7; i++ {
+			total := known[start.AddDate(0, 0, i).Format("2006-01-02")]
+			if total.Points > 0 {
+				kwh += total.Kwh
+				points += total.Points
+				days++
+			}
+		}
+		if days < 7 {
+			continue
+		}
+		acc.AddFields("eredes_weekly", map[string]interface{}{
+			"kwh":          kwh,
+			"avg_power_kw": averagePower(kwh, points),
+			"days":         days,
+		}, eredes.cpeTags(cpe), start)
+	}
+
+	for key := range a.days {
+		if key.cpe == cpe && key.date < oldest {
+			delete(a.days, key)
+		}
+	}
+}
+
+// Consumption of a CPE in a day and number of readings
+func (a *aggregates) total(cpe string, date string) (float64, int) {
+	var kwh float64
+	values := a.days[dayKey{cpe: cpe, date: date}]
+	for _, value := range values {
+		kwh += value
+	}
+	return kwh, len(values)
+}
+
+// Highest quarter-hour consumption of a CPE in a day and its timestamp
+func (a *aggregates) peak(cpe string, date string) (float64, time.Time) {
+	var peak float64
+	var at int64
+	found := false
+	for ts, value := range a.days[dayKey{cpe: cpe, date: date}] {
+		// The first of equal peaks
+		if !found || value > peak || (value == peak && ts < at) {
+			peak = value
+			at = ts
+			found = true
+		}
+	}
+	return peak, time.Unix(at, 0)
+}
+
+// Average power in kW of quarter-hour readings
+func averagePower(kwh float64, points int) float64 {
+	if points == 0 {
+		return 0
+	}
+	return kwh / (float64(points) * 0.25)
+}
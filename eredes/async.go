@@ -0,0 +1,137 @@
+package eredes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Longest wait between polls of an async job
+const maxAsyncPollInterval = time.Minute
+
+// Age after which an async job isn't resumed, the portal has likely
+// dropped its result
+const asyncJobMaxAge = 24 * time.Hour
+
+// Async job of a usage request, persisted in the state file
+type asyncJob struct {
+	ID        string    `json:"id"`
+	Submitted time.Time `json:"submitted"`
+}
+
+// Status of an async job still running, anything else is the result
+var asyncPending = map[string]bool{
+	"pending":    true,
+	"processing": true,
+	"running":    true,
+}
+
+// Status of an async job the portal gave up on, submitted again next time
+var asyncFailed = map[string]bool{
+	"failed": true,
+	"error":  true,
+}
+
+// Submit a usage request with wait=false and poll its result until it's
+// ready, doubling the wait between polls. Large ranges are prepared by the
+// portal in the background instead of timing out the request. The job ID is
+// kept in the state file until the result is received, so the same request
+// after a restart or a timeout resumes polling the job instead of
+// submitting it again.
+func (s *session) requestAsync(body string, token string) ([]byte, error) {
+	state := s.eredes.state
+	sum := sha256.Sum256([]byte(s.name + "\x00" + body))
+	request := hex.EncodeToString(sum[:])
+
+	job, resumed := state.job(request)
+	if resumed {
+		log.Printf("[eredes] resuming usage job %s", job.ID)
+	} else {
+		response, err := s.makeRequest(s.eredes.usageURL(), body, token)
+		if err != nil {
+			return nil, err
+		}
+
+		job = asyncJob{
+			ID:        gjson.GetBytes(response, s.eredes.AsyncIDPath).String(),
+			Submitted: time.Now(),
+		}
+		if job.ID == "" {
+			return nil, fmt.Errorf("no job id in %q", s.eredes.AsyncIDPath)
+		}
+		if err := state.setJob(request, job, s.eredes.StateFile); err != nil {
+			log.Printf("[eredes] error saving state: %s", err)
+		}
+		log.Printf("[eredes] waiting for usage job %s", job.ID)
+	}
+	id := job.ID
+
+	deadline := time.Now().Add(s.eredes.AsyncTimeout.Duration)
+	wait := s.eredes.AsyncPollInterval.Duration
+	for {
+		time.Sleep(wait)
+
+		response, err := s.makeRequest(s.eredes.usageResultURL(), `{"request_id": "`+id+`"}`, token)
+		if err != nil {
+			// The portal may not know a resumed job anymore, the request is
+			// submitted again next time
+			if resumed {
+				if err := state.setJob(request, asyncJob{}, s.eredes.StateFile); err != nil {
+					log.Printf("[eredes] error saving state: %s", err)
+				}
+			}
+			return nil, err
+		}
+
+		status := strings.ToLower(gjson.GetBytes(response, s.eredes.AsyncStatusPath).String())
+		if !asyncPending[status] {
+			if err := state.setJob(request, asyncJob{}, s.eredes.StateFile); err != nil {
+				log.Printf("[eredes] error saving state: %s", err)
+			}
+			if asyncFailed[status] {
+				return nil, fmt.Errorf("usage job %s %s", id, status)
+			}
+			return response, nil
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return nil, fmt.Errorf("usage job %s not ready after %s, polling it again next time", id, s.eredes.AsyncTimeout.Duration)
+		}
+		wait *= 2
+		if wait > maxAsyncPollInterval {
+			wait = maxAsyncPollInterval
+		}
+	}
+}
+
+// Most polls of an async job before async_timeout, following the waits of
+// requestAsync. Reserved in the max_daily_requests budget, the job may
+// take them all.
+func (eredes *EREDES) maxAsyncPolls() int {
+	polls := 0
+	elapsed := time.Duration(0)
+	wait := eredes.AsyncPollInterval.Duration
+	for {
+		elapsed += wait
+		polls++
+		if wait <= 0 || elapsed+wait > eredes.AsyncTimeout.Duration {
+			return polls
+		}
+		wait *= 2
+		if wait > maxAsyncPollInterval {
+			wait = maxAsyncPollInterval
+		}
+	}
+}
+
+func (eredes *EREDES) usageResultURL() string {
+	if eredes.UsageResultURL == "" {
+		return eredesUsageResult
+	}
+	return eredes.UsageResultURL
+}
@@ -0,0 +1,125 @@
+package eredes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Default Authenticator, signs in with the configured credentials
+type passwordAuthenticator struct {
+	session      *session
+	token        string
+	refreshToken string
+
+	// Known only if the token is a JWT
+	tokenInfo *TokenInfo
+}
+
+// Sign in, at most once per min_login_interval. Within the interval the
+// previous token is reused, so retries can't trigger the portal lockout.
+// A JWT is reused until shortly before it expires. After that, the refresh
+// token is tried before signing in again.
+func (a *passwordAuthenticator) SignIn() (string, error) {
+	s := a.session
+	state := s.eredes.state
+
+	// Don't retry until the credentials change
+	fingerprint, err := s.credentialsFingerprint()
+	if err != nil {
+		return "", err
+	}
+	if expired, ok := state.expiredCredentials(s.name); ok && expired == fingerprint {
+		return "", errPasswordExpired
+	}
+
+	if a.token != "" && a.tokenInfo != nil && time.Now().Before(a.tokenInfo.ReauthAt) {
+		log.Printf("[eredes] reusing token, re-auth planned at %s", a.tokenInfo.ReauthAt.Format(time.RFC3339))
+		return a.token, nil
+	}
+
+	lastLogin := state.lastLogin(s.name)
+	wait := s.eredes.MinLoginInterval.Duration - time.Since(lastLogin)
+	if !lastLogin.IsZero() && wait > 0 {
+		if a.token != "" {
+			log.Printf("[eredes] last login less than %s ago, reusing token", s.eredes.MinLoginInterval.Duration)
+			return a.token, nil
+		}
+		return "", fmt.Errorf("login throttled, next attempt allowed in %s", wait.Round(time.Second))
+	}
+
+	// The planner reserves these requests, but a token may expire more than
+	// once a day
+	if s.eredes.remainingRequests() == 0 {
+		return "", fmt.Errorf("max_daily_requests (%d) reached, not signing in", s.eredes.MaxDailyRequests)
+	}
+
+	if a.refreshToken != "" {
+		token, refreshToken, err := s.refreshToken(a.refreshToken)
+		if err == nil {
+			a.setToken(token, refreshToken)
+			return token, nil
+		}
+		log.Printf("[eredes] error refreshing token, signing in: %s", err)
+		if s.eredes.remainingRequests() == 0 {
+			return "", fmt.Errorf("max_daily_requests (%d) reached, not signing in", s.eredes.MaxDailyRequests)
+		}
+	}
+
+	if err := state.setLastLogin(s.name, time.Now(), s.eredes.StateFile); err != nil {
+		log.Printf("[eredes] error saving state: %s", err)
+	}
+
+	token, refreshToken, err := s.signIn()
+	if errors.Is(err, errPasswordExpired) {
+		log.Printf("[eredes] password of %s expired, not signing in again until the credentials change", s.name)
+		if err := state.setExpiredCredentials(s.name, fingerprint, s.eredes.StateFile); err != nil {
+			log.Printf("[eredes] error saving state: %s", err)
+		}
+	}
+	if err != nil {
+		a.setToken("", "")
+		return "", err
+	}
+
+	if _, ok := state.expiredCredentials(s.name); ok {
+		if err := state.setExpiredCredentials(s.name, "", s.eredes.StateFile); err != nil {
+			log.Printf("[eredes] error saving state: %s", err)
+		}
+	}
+
+	a.setToken(token, refreshToken)
+	return token, nil
+}
+
+// Keep the token and, if it's a JWT, when it has to be renewed
+func (a *passwordAuthenticator) setToken(token string, refreshToken string) {
+	a.token = token
+	a.refreshToken = refreshToken
+	a.tokenInfo = nil
+
+	if info, ok := parseJWT(token); ok {
+		a.tokenInfo = &info
+		log.Printf("[eredes] token expires at %s, scopes: [%s], re-auth planned at %s",
+			info.Expires.Format(time.RFC3339),
+			strings.Join(info.Scopes, " "),
+			info.ReauthAt.Format(time.RFC3339))
+	}
+	a.session.eredes.snapshot.recordToken(a.session.name, a.tokenInfo)
+}
+
+// Hash of the current credentials, to tell if they changed without keeping
+// the password in the state file
+func (s *session) credentialsFingerprint() (string, error) {
+	username, password, err := s.credentials()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(sum[:]), nil
+}
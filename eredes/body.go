@@ -0,0 +1,60 @@
+package eredes
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// Counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Read a response body, decompressing it when the portal sent it gzipped.
+// Bodies over max_body_size (decompressed) are an error rather than
+// read whole into memory.
+func readBody(resp *http.Response, url string, maxSize int64) ([]byte, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return readLimited(resp.Body, url, maxSize)
+	}
+
+	compressed := &countingReader{r: resp.Body}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	b, err := readLimited(gz, url, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[eredes] response of %s: %d bytes gzipped, %d bytes", url, compressed.n, len(b))
+	return b, nil
+}
+
+func readLimited(r io.Reader, url string, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("response of %s is larger than max_body_size (%d bytes)", url, maxSize)
+	}
+	return b, nil
+}
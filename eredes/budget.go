@@ -0,0 +1,147 @@
+package eredes
+
+import (
+	"log"
+)
+
+// Requests planned for a CPE in a cycle
+type cpePlan struct {
+	windows   []window
+	daily     bool
+	monthly   bool
+	maxPower  bool
+	registers bool
+	outages   bool
+
+	plannedOutages  bool
+	contractHistory bool
+	contract        bool
+	meter           bool
+}
+
+// Requests an authentication may take: a token refresh and, if it's
+// rejected, a sign in
+const authRequests = 2
+
+// Portal requests left today within max_daily_requests, -1 if there's no cap
+func (eredes *EREDES) remainingRequests() int {
+	if eredes.MaxDailyRequests <= 0 {
+		return -1
+	}
+	remaining := eredes.MaxDailyRequests - eredes.state.requestsToday()
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Plan the requests of the session CPEs within the max_daily_requests
+// budget. The authentication of the next cycle is reserved first, then
+// calls are allocated by priority: the fresh window of CPEs that are up to
+// date, then the daily totals, max power, monthly and register readings,
+// outages and contract history, then the contract and meter details, then
+// the backfill windows, in turns between CPEs. Except for the windows, each
+// type is requested once a day. What doesn't fit is deferred to the next
+// cycles.
+func (eredes *EREDES) planRequests(s *session, cpes []string) map[string]*cpePlan {
+	pending := make(map[string][]window)
+	plans := make(map[string]*cpePlan)
+	for _, cpe := range cpes {
+		pending[cpe] = eredes.pendingWindows(cpe)
+		plans[cpe] = &cpePlan{}
+	}
+
+	remaining := eredes.remainingRequests()
+	if remaining >= 0 {
+		remaining -= authRequests
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+	take := func(n int) bool {
+		if remaining < 0 {
+			return true
+		}
+		if remaining < n {
+			return false
+		}
+		remaining -= n
+		return true
+	}
+
+	// Windows take a request per direction and UPAC flow, async ones the
+	// submit and every poll it may take
+	windowCost := 1
+	if eredes.IncludeInjection {
+		windowCost++
+	}
+	if eredes.UPAC {
+		windowCost += len(upacFlows)
+	}
+	if eredes.Async {
+		windowCost *= 1 + eredes.maxAsyncPolls()
+	}
+
+	deferred := 0
+
+	// One request per CPE of a type, for the ones it's due
+	allocate := func(enabled bool, due func(cpe string) bool, plan func(p *cpePlan)) {
+		if !enabled {
+			return
+		}
+		for _, cpe := range cpes {
+			if !due(cpe) {
+				continue
+			}
+			if take(1) {
+				plan(plans[cpe])
+			} else {
+				deferred++
+			}
+		}
+	}
+
+	for _, cpe := range cpes {
+		if len(pending[cpe]) == 1 {
+			if take(windowCost) {
+				plans[cpe].windows = pending[cpe]
+			} else {
+				deferred++
+			}
+			pending[cpe] = nil
+		}
+	}
+
+	allocate(eredes.DailyTotals, s.dailyFetched.due, func(p *cpePlan) { p.daily = true })
+	allocate(eredes.MaxPower, s.maxPowerFetched.due, func(p *cpePlan) { p.maxPower = true })
+	allocate(eredes.MonthlyReadings, s.monthlyFetched.due, func(p *cpePlan) { p.monthly = true })
+	allocate(eredes.RegisterReadings, s.registersFetched.due, func(p *cpePlan) { p.registers = true })
+	allocate(eredes.Outages, s.outagesFetched.due, func(p *cpePlan) { p.outages = true })
+	allocate(eredes.PlannedOutages, s.plannedOutagesFetched.due, func(p *cpePlan) { p.plannedOutages = true })
+	allocate(eredes.ContractHistory, s.contractHistoryFetched.due, func(p *cpePlan) { p.contractHistory = true })
+	allocate(eredes.ContractMetadata, s.contractDue, func(p *cpePlan) { p.contract = true })
+	allocate(eredes.MeterMetadata, s.meterDue, func(p *cpePlan) { p.meter = true })
+
+	for more := true; more; {
+		more = false
+		for _, cpe := range cpes {
+			if len(pending[cpe]) == 0 {
+				continue
+			}
+			more = true
+			if take(windowCost) {
+				plans[cpe].windows = append(plans[cpe].windows, pending[cpe][0])
+				pending[cpe] = pending[cpe][1:]
+			} else {
+				deferred += len(pending[cpe])
+				pending[cpe] = nil
+			}
+		}
+	}
+
+	if deferred > 0 {
+		log.Printf("[eredes] max_daily_requests (%d) reached, %d requests of %s deferred", eredes.MaxDailyRequests, deferred, s.name)
+	}
+
+	return plans
+}
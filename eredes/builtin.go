@@ -0,0 +1,247 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/plugins/parsers"
+	"github.com/influxdata/telegraf/plugins/parsers/influx"
+	"github.com/tidwall/gjson"
+)
+
+// Keys of the reading timestamp, the first found is used
+var builtinTimeKeys = []string{"loadCurveTimestamp", "date"}
+
+// Layouts of the reading timestamps. Without a zone they're in timezone.
+var builtinTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	// Formatted variant
+	"02/01/2006 15:04:05",
+	"02/01/2006 15:04",
+	"02/01/2006",
+}
+
+// Known envelopes of the usage response, newest first. The portal changed
+// where it puts the readings more than once.
+var usageEnvelopes = []envelope{
+	{name: "utilities devices", path: "Body.Result.utilitiesDevices.0.meterLoadCurves.0.loadCurves"},
+	{name: "load curves", path: "Body.Result.loadCurves"},
+	{name: "result array", path: "Body.Result"},
+	// The formatted variant, already selected at formatted_path
+	{name: "formatted", path: ""},
+}
+
+type envelope struct {
+	name string
+	path string
+	json parsers.Parser
+}
+
+// Parser of the usage response when data_format isn't set. Reads the load
+// curve at data_json_path, or in the first known envelope found, into
+// eredes metrics with a kwh field, at the time of the reading.
+type builtinParser struct {
+	envelopes []envelope
+	location  *time.Location
+
+	// Envelope of the last response, to log when it changes
+	matched string
+}
+
+func newBuiltinParser(dataPath string, qualityKey string, sourceKey string, phaseKeys []string, location *time.Location) (*builtinParser, error) {
+	stringFields := append([]string{"meterLoadCurve"}, builtinTimeKeys...)
+	if qualityKey != "" {
+		stringFields = append(stringFields, qualityKey)
+	}
+	if sourceKey != "" {
+		stringFields = append(stringFields, sourceKey)
+	}
+	stringFields = append(stringFields, phaseKeys...)
+
+	envelopes := usageEnvelopes
+	if dataPath != "" {
+		envelopes = []envelope{{name: "data_json_path", path: dataPath}}
+	}
+
+	p := &builtinParser{location: location}
+	for _, e := range envelopes {
+		json, err := parsers.NewParser(&parsers.Config{
+			DataFormat:       "json",
+			MetricName:       "eredes",
+			JSONQuery:        e.path,
+			JSONStringFields: stringFields,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.envelopes = append(p.envelopes, envelope{name: e.name, path: e.path, json: json})
+	}
+	return p, nil
+}
+
+// Envelope of the response, the first with an array of readings. With a
+// single envelope (data_json_path) it's used as is, so validate reports
+// what's wrong with it.
+func (p *builtinParser) envelope(buf []byte) envelope {
+	if len(p.envelopes) > 1 {
+		for _, e := range p.envelopes {
+			if readingsAt(buf, e.path).IsArray() {
+				if e.name != p.matched {
+					log.Printf("[eredes] usage response matched the %s envelope (%s)", e.name, e.path)
+					p.matched = e.name
+				}
+				return e
+			}
+		}
+	}
+	return p.envelopes[0]
+}
+
+func (p *builtinParser) Parse(buf []byte) ([]telegraf.Metric, error) {
+	e := p.envelope(buf)
+	if err := p.validate(buf, e.path); err != nil {
+		return nil, err
+	}
+
+	metrics, err := e.json.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty value is a missing reading, it's left out
+	readings := metrics[:0]
+	for _, metric := range metrics {
+		t, err := readingTime(metric, p.location)
+		if err != nil {
+			return nil, err
+		}
+		metric.SetTime(t)
+
+		value, ok := metric.GetField("meterLoadCurve")
+		if !ok {
+			continue
+		}
+		metric.RemoveField("meterLoadCurve")
+		if kwh, ok := readingValue(value); ok {
+			metric.AddField("kwh", kwh)
+			readings = append(readings, metric)
+		}
+	}
+	return readings, nil
+}
+
+// Readings at a path of the response, the whole response without one
+func readingsAt(buf []byte, path string) gjson.Result {
+	if path == "" {
+		return gjson.ParseBytes(buf)
+	}
+	return gjson.GetBytes(buf, path)
+}
+
+// Value of a reading, a number in the raw variant and a string like
+// "0,125 kWh" in the formatted one
+func readingValue(value interface{}) (float64, bool) {
+	if v, ok := toFloat(value); ok {
+		return v, true
+	}
+	s, ok := value.(string)
+	if !ok {
+		return 0, false
+	}
+	s = strings.TrimSpace(s)
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(s, "kWh"), "kwh"))
+	return toFloat(strings.Replace(s, ",", ".", 1))
+}
+
+// Checks the readings have the expected structure, so a changed response
+// fails with the reading at fault instead of giving no or zero readings
+func (p *builtinParser) validate(buf []byte, dataPath string) error {
+	if !gjson.ValidBytes(buf) {
+		return fmt.Errorf("response isn't valid JSON")
+	}
+
+	readings := readingsAt(buf, dataPath)
+	if !readings.Exists() {
+		return fmt.Errorf("no readings at %q", dataPath)
+	}
+	if !readings.IsArray() {
+		return fmt.Errorf("readings at %q aren't an array", dataPath)
+	}
+
+	for i, reading := range readings.Array() {
+		if !reading.IsObject() {
+			return fmt.Errorf("reading at index %d isn't an object", i)
+		}
+
+		hasTime := false
+		for _, key := range builtinTimeKeys {
+			if reading.Get(key).Exists() {
+				hasTime = true
+				break
+			}
+		}
+		if !hasTime {
+			return fmt.Errorf("field '%s' missing at index %d", builtinTimeKeys[0], i)
+		}
+
+		value := reading.Get("meterLoadCurve")
+		if !value.Exists() {
+			return fmt.Errorf("field 'meterLoadCurve' missing at index %d", i)
+		}
+		// An empty value is a missing reading rather than a changed response
+		if value.Type == gjson.Null || value.String() == "" {
+			continue
+		}
+		if _, ok := readingValue(value.Value()); !ok {
+			return fmt.Errorf("field 'meterLoadCurve' at index %d isn't a number: %s", i, value.Raw)
+		}
+	}
+	return nil
+}
+
+// Timestamp of a parsed reading, removed from its fields. Readings without
+// one are an error rather than stamped with the gather time.
+func readingTime(metric telegraf.Metric, location *time.Location) (time.Time, error) {
+	for _, key := range builtinTimeKeys {
+		value, ok := metric.GetField(key)
+		if !ok {
+			continue
+		}
+		metric.RemoveField(key)
+
+		raw, _ := value.(string)
+		for _, layout := range builtinTimeLayouts {
+			if t, err := time.ParseInLocation(layout, raw, location); err == nil {
+				return t, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("invalid reading %s %q", key, raw)
+	}
+	return time.Time{}, fmt.Errorf("reading without %s", builtinTimeKeys[0])
+}
+
+func (p *builtinParser) ParseLine(line string) (telegraf.Metric, error) {
+	return p.envelopes[0].json.ParseLine(line)
+}
+
+func (p *builtinParser) SetDefaultTags(tags map[string]string) {
+	for _, e := range p.envelopes {
+		e.json.SetDefaultTags(tags)
+	}
+}
+
+// Telegraf sets the influx parser when data_format isn't configured, it
+// can't read the portal responses
+func defaultParser(parser parsers.Parser) bool {
+	if parser == nil {
+		return true
+	}
+	_, ok := parser.(*influx.Parser)
+	return ok
+}
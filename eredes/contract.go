@@ -0,0 +1,146 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/tidwall/gjson"
+)
+
+// Contract details of a supply point, added to its readings
+type contract struct {
+	contractedPower float64
+	tariffOption    string
+	voltageLevel    string
+
+	fetchedAt time.Time
+}
+
+// Contracts of the session CPEs, refreshed daily. CPEs are gathered
+// concurrently.
+type contracts struct {
+	sync.Mutex
+	byCpe map[string]*contract
+}
+
+// Tells if the contract of a CPE has to be fetched
+func (s *session) contractDue(cpe string) bool {
+	c := s.cachedContract(cpe)
+	return c == nil || time.Since(c.fetchedAt) >= 24*time.Hour
+}
+
+// Returns the last contract fetched of a CPE, nil if none
+func (s *session) cachedContract(cpe string) *contract {
+	s.contracts.Lock()
+	defer s.contracts.Unlock()
+
+	return s.contracts.byCpe[cpe]
+}
+
+// Returns the contract of a CPE, fetched again if older than a day. On error
+// the previous one is kept, if any.
+func (s *session) contract(cpe string, token string) (*contract, error) {
+	c := s.cachedContract(cpe)
+	if !s.contractDue(cpe) {
+		return c, nil
+	}
+
+	fetched, err := s.fetchContract(cpe, token)
+	if err != nil {
+		return c, err
+	}
+
+	s.contracts.Lock()
+	defer s.contracts.Unlock()
+	if s.contracts.byCpe == nil {
+		s.contracts.byCpe = make(map[string]*contract)
+	}
+	s.contracts.byCpe[cpe] = fetched
+	return fetched, nil
+}
+
+func (s *session) fetchContract(cpe string, token string) (*contract, error) {
+	log.Printf("[eredes] fetching contract of %s", cpe)
+	response, err := s.makeRequest(s.eredes.contractURL(), `{"cpe": "`+cpe+`"}`, token)
+	if err != nil {
+		return nil, err
+	}
+
+	result := gjson.GetBytes(response, "Body.Result")
+	if !result.Exists() {
+		return nil, fmt.Errorf("no contract in response")
+	}
+
+	return &contract{
+		contractedPower: result.Get("contractedPower").Float(),
+		tariffOption:    result.Get("tariffOption").String(),
+		voltageLevel:    result.Get("voltageLevel").String(),
+		fetchedAt:       time.Now(),
+	}, nil
+}
+
+// Add the contract details to the tags and fields of a reading
+func (c *contract) apply(tags map[string]string, fields map[string]interface{}) {
+	if c.tariffOption != "" {
+		tags["tariff_option"] = c.tariffOption
+	}
+	if c.voltageLevel != "" {
+		tags["voltage_level"] = c.voltageLevel
+	}
+	if c.contractedPower != 0 {
+		fields["contracted_power_kva"] = c.contractedPower
+	}
+}
+
+func (eredes *EREDES) contractURL() string {
+	if eredes.ContractURL == "" {
+		return eredesContract
+	}
+	return eredes.ContractURL
+}
+
+// Request the contracted power changes of the CPE and emit them as
+// eredes_contracted_power, one point at each change with the new
+// contracted_power_kva. Fetched once a day.
+func (eredes *EREDES) gatherContractHistory(acc telegraf.Accumulator, s *session, token string, cpe string) error {
+	log.Printf("[eredes] requesting contract history of %s", cpe)
+	response, err := s.makeRequest(eredes.contractHistoryURL(), `{"cpe": "`+cpe+`"}`, token)
+	if err != nil {
+		return err
+	}
+
+	changes := gjson.GetBytes(response, eredes.ContractHistoryPath)
+	if !changes.Exists() {
+		return fmt.Errorf("no contract history in %q", eredes.ContractHistoryPath)
+	}
+
+	for _, change := range changes.Array() {
+		date, err := time.ParseInLocation("2006-01-02", change.Get("startDate").String(), eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid contract change date: %s", err)
+		}
+
+		tags := eredes.cpeTags(cpe)
+		if tariffOption := change.Get("tariffOption").String(); tariffOption != "" {
+			tags["tariff_option"] = tariffOption
+		}
+		fields := map[string]interface{}{
+			"contracted_power_kva": change.Get("contractedPower").Float(),
+		}
+		acc.AddFields("eredes_contracted_power", fields, tags, date)
+	}
+	s.contractHistoryFetched.done(cpe)
+
+	log.Printf("[eredes] added %d contract changes of %s", len(changes.Array()), cpe)
+	return nil
+}
+
+func (eredes *EREDES) contractHistoryURL() string {
+	if eredes.ContractHistoryURL == "" {
+		return eredesContractHistory
+	}
+	return eredes.ContractHistoryURL
+}
@@ -0,0 +1,173 @@
+package eredes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookies stored per account and URL
+type storedCookies map[string]map[string][]storedCookie
+
+type storedCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain,omitempty"`
+	Path   string `json:"path,omitempty"`
+	// Zero for a session cookie
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (c storedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// Cookie jar that also keeps the cookies set with their domain, path and
+// expiry, which the jar doesn't hand back, so they can be saved
+type recordingJar struct {
+	*cookiejar.Jar
+
+	lock sync.Mutex
+	// Cookies per URL they were set from (scheme and host), by domain,
+	// path and name
+	set map[string]map[string]storedCookie
+}
+
+func newRecordingJar() (*recordingJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingJar{Jar: jar, set: make(map[string]map[string]storedCookie)}, nil
+}
+
+func (j *recordingJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	origin := u.Scheme + "://" + u.Host
+	now := time.Now()
+	for _, c := range cookies {
+		stored := storedCookie{Name: c.Name, Value: c.Value, Domain: c.Domain, Path: c.Path, Expires: c.Expires}
+		if stored.Path == "" || stored.Path[0] != '/' {
+			stored.Path = defaultCookiePath(u.Path)
+		}
+		// Max-Age wins over Expires, a negative one deletes the cookie
+		if c.MaxAge > 0 {
+			stored.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		} else if c.MaxAge < 0 {
+			stored.Expires = now
+		}
+
+		key := stored.Domain + ";" + stored.Path + ";" + stored.Name
+		if stored.expired(now) {
+			delete(j.set[origin], key)
+			continue
+		}
+		if j.set[origin] == nil {
+			j.set[origin] = make(map[string]storedCookie)
+		}
+		j.set[origin][key] = stored
+	}
+}
+
+// Cookies set per URL, without the expired ones
+func (j *recordingJar) stored() map[string][]storedCookie {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	stored := make(map[string][]storedCookie)
+	now := time.Now()
+	for origin, cookies := range j.set {
+		for _, c := range cookies {
+			if !c.expired(now) {
+				stored[origin] = append(stored[origin], c)
+			}
+		}
+	}
+	return stored
+}
+
+// Path of a cookie set without one, the directory of the request path
+// (RFC 6265 5.1.4)
+func defaultCookiePath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// Load the cookies saved by a previous run into the session jar, except the
+// expired ones
+func (eredes *EREDES) loadCookies(s *session) error {
+	if eredes.CookieFile == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(eredes.CookieFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var stored storedCookies
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for rawURL, cookies := range stored[s.name] {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+
+		httpCookies := make([]*http.Cookie, 0, len(cookies))
+		for _, c := range cookies {
+			if c.expired(now) {
+				continue
+			}
+			httpCookies = append(httpCookies, &http.Cookie{
+				Name:    c.Name,
+				Value:   c.Value,
+				Domain:  c.Domain,
+				Path:    c.Path,
+				Expires: c.Expires,
+			})
+		}
+		s.jar.SetCookies(u, httpCookies)
+	}
+
+	return nil
+}
+
+// Save the session cookies of every account to file, writing to a
+// temporary file first like the state
+func (eredes *EREDES) saveCookies() error {
+	if eredes.CookieFile == "" {
+		return nil
+	}
+
+	stored := make(storedCookies)
+	for _, s := range eredes.sessions {
+		stored[s.name] = s.jar.stored()
+	}
+
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(eredes.CookieFile, b)
+}
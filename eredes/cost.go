@@ -0,0 +1,129 @@
+package eredes
+
+import (
+	"math"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Tariff has the prices of the contract for the cost estimate. Readings
+// without a tariff_period (no tariff_cycle, daily readings) use simple.
+type Tariff struct {
+	// €/kWh per tariff period
+	Simple float64 `toml:"simple"`
+	Vazio  float64 `toml:"vazio"`
+	Cheias float64 `toml:"cheias"`
+	Ponta  float64 `toml:"ponta"`
+
+	// Fixed charge per day (termo fixo of the contracted power), €
+	DailyCharge float64 `toml:"daily_charge"`
+
+	// Taxes added to the daily cost, none if not set
+	Taxes *Taxes `toml:"taxes"`
+}
+
+// Taxes of the electricity bill in Portugal, applied to the cost of each
+// day. Monthly amounts are spread over the days of the year.
+type Taxes struct {
+	// IVA rates, normal (ex: 0.23) and reduced (ex: 0.06)
+	IVA        float64 `toml:"iva"`
+	ReducedIVA float64 `toml:"reduced_iva"`
+
+	// Consumption per 30 days with reduced IVA (ex: 100, 150 for large
+	// families), for contracted powers up to 6.9 kVA
+	ReducedIVAKwh float64 `toml:"reduced_iva_kwh"`
+	// Reduced IVA on daily_charge, for contracted powers up to 3.45 kVA
+	ReducedIVADailyCharge bool `toml:"reduced_iva_daily_charge"`
+
+	// Imposto especial de consumo, €/kWh
+	IEC float64 `toml:"iec"`
+
+	// DGEG exploration fee (normal IVA) and audiovisual contribution, CAV
+	// (reduced IVA), € per month
+	DGEG float64 `toml:"dgeg"`
+	CAV  float64 `toml:"cav"`
+}
+
+// Taxes of a day, with its consumption and its energy and fixed cost
+func (t *Taxes) daily(kwh float64, energy float64, fixed float64) float64 {
+	iec := kwh * t.IEC
+
+	// The reduced IVA allowance is counted per day
+	reduced := 0.0
+	if kwh > 0 {
+		reduced = math.Min(1, t.ReducedIVAKwh/30/kwh)
+	}
+	taxes := iec + (energy+iec)*(reduced*t.ReducedIVA+(1-reduced)*t.IVA)
+
+	if t.ReducedIVADailyCharge {
+		taxes += fixed * t.ReducedIVA
+	} else {
+		taxes += fixed * t.IVA
+	}
+
+	perDay := 12.0 / 365
+	taxes += t.DGEG * perDay * (1 + t.IVA)
+	taxes += t.CAV * perDay * (1 + t.ReducedIVA)
+	return taxes
+}
+
+// €/kWh of a tariff period
+func (t *Tariff) price(period string) float64 {
+	switch period {
+	case "vazio":
+		return t.Vazio
+	case "cheias":
+		return t.Cheias
+	case "ponta":
+		return t.Ponta
+	}
+	return t.Simple
+}
+
+// Estimated cost and consumption per day of the readings of a window
+type dailyCosts map[time.Time]*dailyCost
+
+type dailyCost struct {
+	eur float64
+	kwh float64
+}
+
+// Add the estimated_cost_eur field to a consumption reading and count it in
+// the cost of its day
+func (eredes *EREDES) addCost(costs dailyCosts, tags map[string]string, fields map[string]interface{}, r Reading) {
+	if eredes.Tariff == nil || (r.Direction != "" && r.Direction != "consumption") {
+		return
+	}
+
+	cost := r.Kwh * eredes.Tariff.price(tags["tariff_period"])
+	fields["estimated_cost_eur"] = cost
+
+	day := r.Time.In(eredes.location)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, eredes.location)
+	if costs[day] == nil {
+		costs[day] = &dailyCost{}
+	}
+	costs[day].eur += cost
+	costs[day].kwh += r.Kwh
+}
+
+// Emit the estimated cost of each day as eredes_cost, with the daily
+// charge and the taxes (taxes_eur) if set. Monthly readings aren't split in
+// days.
+func (eredes *EREDES) addDailyCosts(acc telegraf.Accumulator, cpe string, costs dailyCosts) {
+	if eredes.ReadingType == "monthly" {
+		return
+	}
+	for day, cost := range costs {
+		total := cost.eur + eredes.Tariff.DailyCharge
+		fields := map[string]interface{}{}
+		if taxes := eredes.Tariff.Taxes; taxes != nil {
+			tax := taxes.daily(cost.kwh, cost.eur, eredes.Tariff.DailyCharge)
+			fields["taxes_eur"] = tax
+			total += tax
+		}
+		fields["estimated_cost_eur"] = total
+		acc.AddFields("eredes_cost", fields, eredes.cpeTags(cpe), day)
+	}
+}
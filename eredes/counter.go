@@ -0,0 +1,80 @@
+package eredes
+
+import (
+	"sync"
+	"time"
+)
+
+// Running total of the consumption of a CPE, persisted in the state file
+type counter struct {
+	Kwh float64 `json:"kwh"`
+	// Time of the last reading counted, readings requested again aren't
+	// counted twice
+	Until time.Time `json:"until"`
+}
+
+// Running totals of the current cycle. They start from the total in the
+// state and are only committed to it with the watermark, a window
+// requested again (ex: it failed) is counted again from the same total.
+type pendingTotals struct {
+	sync.Mutex
+	counters map[string]counter
+}
+
+// Add a reading to the running total of a CPE, starting from committed.
+// Returns false for a reading at or before the last one counted.
+func (p *pendingTotals) add(cpe string, committed counter, kwh float64, t time.Time) (float64, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.counters == nil {
+		p.counters = make(map[string]counter)
+	}
+	c, ok := p.counters[cpe]
+	if !ok {
+		c = committed
+	}
+	if !t.After(c.Until) {
+		return 0, false
+	}
+	c.Kwh += kwh
+	c.Until = t
+	p.counters[cpe] = c
+	return c.Kwh, true
+}
+
+// Returns and clears the running total of a CPE
+func (p *pendingTotals) take(cpe string) (counter, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	c, ok := p.counters[cpe]
+	delete(p.counters, cpe)
+	return c, ok
+}
+
+// Add the consumption_total_kwh field, the running total of the
+// consumption including the reading. Readings are counted in order, the
+// ones at or before the last one counted don't get the field, so the
+// counter never goes back. Neither do the ones after an estimated reading
+// dropped, they're counted once the window is requested again.
+func (eredes *EREDES) addTotal(fields map[string]interface{}, r Reading) {
+	if !eredes.CumulativeCounter || (r.Direction != "" && r.Direction != "consumption") {
+		return
+	}
+	if eredes.estimates.heldBack(r.Cpe, r.Time) {
+		return
+	}
+
+	total, ok := eredes.totals.add(r.Cpe, eredes.state.total(r.Cpe), r.Kwh, r.Time)
+	if ok {
+		fields["consumption_total_kwh"] = total
+	}
+}
+
+// Commit the running total of a CPE, once its window is committed
+func (eredes *EREDES) commitTotal(cpe string) {
+	if c, ok := eredes.totals.take(cpe); ok {
+		eredes.state.setTotal(cpe, c)
+	}
+}
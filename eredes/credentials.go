@@ -0,0 +1,79 @@
+package eredes
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Credentials stored in the encrypted_credentials_file
+type encryptedCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Decrypt the credentials file. The file has the base64 encoded AES-GCM
+// nonce followed by the ciphertext of the JSON credentials; the key file
+// has the hex or base64 encoded 256 bit key.
+func decryptCredentials(path string, keyPath string) (*encryptedCredentials, error) {
+	key, err := readKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("credentials file isn't base64 encoded: %s", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("credentials file is too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting credentials, wrong key?")
+	}
+
+	var credentials encryptedCredentials
+	if err := json.Unmarshal(plaintext, &credentials); err != nil {
+		return nil, fmt.Errorf("decrypted credentials aren't valid JSON: %s", err)
+	}
+
+	return &credentials, nil
+}
+
+func readKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	encoded := strings.TrimSpace(string(b))
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key file must have a hex or base64 encoded 32 byte key")
+	}
+
+	return key, nil
+}
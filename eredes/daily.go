@@ -0,0 +1,51 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/tidwall/gjson"
+)
+
+// Request the daily totals series of the CPE range and emit one eredes_daily
+// point per day. Fetched once a day, the whole range each time, so late
+// corrections of the portal are picked up.
+func (eredes *EREDES) gatherDaily(acc telegraf.Accumulator, s *session, token string, cpe string) error {
+	startDate, endDate := eredes.requestWindow(cpe)
+	start := startDate.Format("2006-01-02 15:04:05")
+	end := endDate.Format("2006-01-02 15:04:05")
+
+	body := `{"cpe": "` + cpe + `", "request_type":"` + readingTypes["daily"] + `","start_date":"` + start + `","end_date":"` + end + `","wait":true,"formatted":false}`
+
+	log.Printf("[eredes] requesting daily totals of %s", cpe)
+	response, err := s.makeRequest(eredes.usageURL(), body, token)
+	if err != nil {
+		return err
+	}
+
+	days := gjson.GetBytes(response, eredes.DailyTotalsPath)
+	if !days.Exists() {
+		return fmt.Errorf("no daily totals in %q", eredes.DailyTotalsPath)
+	}
+
+	added := 0
+	for _, day := range days.Array() {
+		date, err := time.ParseInLocation("2006-01-02", day.Get(eredes.DailyTotalsDateKey).String(), eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid daily total date: %s", err)
+		}
+		value := day.Get(eredes.DailyTotalsValueKey)
+		if !value.Exists() {
+			continue
+		}
+
+		acc.AddFields("eredes_daily", map[string]interface{}{"kwh": value.Float()}, eredes.cpeTags(cpe), date)
+		added++
+	}
+
+	log.Printf("[eredes] added %d daily totals of %s", added, cpe)
+	s.dailyFetched.done(cpe)
+	return nil
+}
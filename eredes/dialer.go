@@ -0,0 +1,153 @@
+package eredes
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+type dialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+// Dial network per ip_family
+var ipFamilies = map[string]string{
+	"":     "",
+	"any":  "",
+	"ipv4": "tcp4",
+	"ipv6": "tcp6",
+}
+
+// Dialer of the portal connections: over ip_family from local_address,
+// hosts resolved with host_overrides or resolver, through
+// socks5_proxy_addr when set. The proxy resolves the hosts it's asked for,
+// so with it host_overrides still applies (the proxy gets the IP) but
+// resolver only resolves the proxy, and ip_family is rejected.
+func (eredes *EREDES) dialer() (dialFunc, error) {
+	family, ok := ipFamilies[eredes.IPFamily]
+	if !ok {
+		return nil, fmt.Errorf("invalid ip_family %q, expected ipv4, ipv6 or any", eredes.IPFamily)
+	}
+	if family != "" && eredes.Socks5ProxyAddr != "" {
+		return nil, fmt.Errorf("ip_family can't be used with socks5_proxy_addr, the proxy resolves the portal hosts")
+	}
+
+	base := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	localIP, err := eredes.localIP()
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil {
+		base.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+
+	if eredes.Resolver != "" {
+		resolver := eredes.Resolver
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		base.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+
+	dial := base.DialContext
+	if eredes.Socks5ProxyAddr != "" {
+		var auth *proxy.Auth
+		if eredes.Socks5Username != "" {
+			auth = &proxy.Auth{User: eredes.Socks5Username, Password: eredes.Socks5Password}
+		}
+		socks, err := proxy.SOCKS5("tcp", eredes.Socks5ProxyAddr, auth, base)
+		if err != nil {
+			return nil, fmt.Errorf("socks5_proxy_addr: %s", err)
+		}
+		contextDialer, ok := socks.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("socks5_proxy_addr: dialer doesn't support contexts")
+		}
+		dial = contextDialer.DialContext
+	}
+
+	if family != "" {
+		inner := dial
+		dial = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if network == "tcp" {
+				network = family
+			}
+			return inner(ctx, network, addr)
+		}
+	}
+
+	if len(eredes.HostOverrides) == 0 {
+		return dial, nil
+	}
+	for host, ip := range eredes.HostOverrides {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("host_overrides: invalid IP %q of %s", ip, host)
+		}
+	}
+
+	// TLS still verifies the certificate against the host name of the URL
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip, ok := eredes.HostOverrides[host]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+		return dial(ctx, network, addr)
+	}, nil
+}
+
+// Address the connections leave from, local_address or the first address
+// of local_interface (IPv4 if it has one, unless ip_family is ipv6). Nil
+// for the system's choice.
+func (eredes *EREDES) localIP() (net.IP, error) {
+	if eredes.LocalAddress != "" {
+		ip := net.ParseIP(eredes.LocalAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local_address %q", eredes.LocalAddress)
+		}
+		return ip, nil
+	}
+	if eredes.LocalInterface == "" {
+		return nil, nil
+	}
+
+	iface, err := net.InterfaceByName(eredes.LocalInterface)
+	if err != nil {
+		return nil, fmt.Errorf("local_interface: %s", err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("local_interface: %s", err)
+	}
+
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) != (eredes.IPFamily == "ipv6") {
+			return ipNet.IP, nil
+		}
+		if found == nil && ipFamilies[eredes.IPFamily] == "" {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("local_interface %s has no usable address", eredes.LocalInterface)
+	}
+	return found, nil
+}
@@ -0,0 +1,73 @@
+package eredes
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Newest reading emitted per CPE and direction in the current cycle, only
+// committed to the state with the watermark, so a window requested again
+// (ex: it failed, or held back by estimated readings) is emitted again
+type pendingEmitted struct {
+	sync.Mutex
+	newest map[string]time.Time
+}
+
+// Record the newest of the readings emitted
+func (p *pendingEmitted) add(cpe string, direction string, t time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.newest == nil {
+		p.newest = make(map[string]time.Time)
+	}
+	if key := cpe + "/" + direction; t.After(p.newest[key]) {
+		p.newest[key] = t
+	}
+}
+
+// Returns and clears the newest readings emitted of a CPE, per direction
+func (p *pendingEmitted) take(cpe string) map[string]time.Time {
+	p.Lock()
+	defer p.Unlock()
+
+	newest := make(map[string]time.Time)
+	for key, t := range p.newest {
+		if direction := strings.TrimPrefix(key, cpe+"/"); direction != key {
+			newest[direction] = t
+			delete(p.newest, key)
+		}
+	}
+	return newest
+}
+
+// Newest reading emitted of a CPE and direction with skip_emitted, zero
+// otherwise so no reading is skipped
+func (eredes *EREDES) emittedUntil(cpe string, direction string) time.Time {
+	if !eredes.SkipEmitted {
+		return time.Time{}
+	}
+	return eredes.state.emitted(cpe, direction)
+}
+
+// Record the newest of the readings emitted, with skip_emitted
+func (eredes *EREDES) setEmitted(cpe string, direction string, readings []Reading) {
+	if !eredes.SkipEmitted {
+		return
+	}
+	for _, r := range readings {
+		eredes.emitted.add(cpe, direction, r.Time)
+	}
+}
+
+// Commit the readings emitted of a CPE up to the watermark, the ones after
+// it are requested and emitted again
+func (eredes *EREDES) commitEmitted(cpe string, watermark time.Time) {
+	for direction, t := range eredes.emitted.take(cpe) {
+		if t.After(watermark) {
+			t = watermark
+		}
+		eredes.state.setEmitted(cpe, direction, t)
+	}
+}
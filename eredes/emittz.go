@@ -0,0 +1,35 @@
+package eredes
+
+import (
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Accumulator writing the metric timestamps as the wall clock time in the
+// timezone, as if it were UTC, for emit_timezone = "local". Metrics stamped
+// with the gather time are left alone.
+type localAccumulator struct {
+	telegraf.Accumulator
+	location *time.Location
+}
+
+func (a *localAccumulator) local(t []time.Time) []time.Time {
+	if len(t) == 0 {
+		return t
+	}
+	l := t[0].In(a.location)
+	return []time.Time{time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), l.Nanosecond(), time.UTC)}
+}
+
+func (a *localAccumulator) AddFields(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddFields(measurement, fields, tags, a.local(t)...)
+}
+
+func (a *localAccumulator) AddGauge(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddGauge(measurement, fields, tags, a.local(t)...)
+}
+
+func (a *localAccumulator) AddCounter(measurement string, fields map[string]interface{}, tags map[string]string, t ...time.Time) {
+	a.Accumulator.AddCounter(measurement, fields, tags, a.local(t)...)
+}
@@ -2,21 +2,31 @@ package eredes
 
 // TODOs:
 // 1 Add retry logic (after 1h for N attempts) if error, timeout or no results
-// 2 When using start date, use only in first request, then history interval
-// 3 Store last successful date and use that if retries failed
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/filter"
 	"github.com/influxdata/telegraf/internal"
-	"github.com/influxdata/telegraf/plugins/common/tls"
+	tlsint "github.com/influxdata/telegraf/plugins/common/tls"
 	"github.com/influxdata/telegraf/plugins/inputs"
 	"github.com/influxdata/telegraf/plugins/parsers"
 	"github.com/tidwall/gjson"
@@ -26,34 +36,286 @@ import (
 type EREDES struct {
 	Headers map[string]string `toml:"headers"`
 
-	SignInURL string `toml:"sign_in_url"`
-	UsageURL  string `toml:"usage_url"`
+	SignInURL           string `toml:"sign_in_url"`
+	RefreshURL          string `toml:"refresh_url"`
+	UsageURL            string `toml:"usage_url"`
+	UsageResultURL      string `toml:"usage_result_url"`
+	CpesURL             string `toml:"cpes_url"`
+	ContractURL         string `toml:"contract_url"`
+	ContractHistoryURL  string `toml:"contract_history_url"`
+	MeterURL            string `toml:"meter_url"`
+	MonthlyReadingsURL  string `toml:"monthly_readings_url"`
+	MaxPowerURL         string `toml:"max_power_url"`
+	RegisterReadingsURL string `toml:"register_readings_url"`
+	OutagesURL          string `toml:"outages_url"`
+	PlannedOutagesURL   string `toml:"planned_outages_url"`
 
-	Username string `toml:"username"`
-	Password string `toml:"password"`
-	Cpe      string `toml:"cpe"`
+	Username string   `toml:"username"`
+	Password string   `toml:"password"`
+	Cpe      string   `toml:"cpe"`
+	Cpes     []string `toml:"cpes"`
 
-	tls.ClientConfig
+	CpeAliases map[string]string `toml:"cpe_aliases"`
+
+	DiscoverCpes     bool   `toml:"discover_cpes"`
+	DiscoverCpesPath string `toml:"discover_cpes_path"`
+
+	TokenJSONPath string `toml:"token_json_path"`
+	DataJSONPath  string `toml:"data_json_path"`
+
+	ContractMetadata bool `toml:"contract_metadata"`
+	MeterMetadata    bool `toml:"meter_metadata"`
+
+	Accounts []*Account `toml:"account"`
+
+	EncryptedCredentialsFile string `toml:"encrypted_credentials_file"`
+	CredentialsKeyFile       string `toml:"credentials_key_file"`
+
+	VaultAddress     string `toml:"vault_address"`
+	VaultPath        string `toml:"vault_path"`
+	VaultToken       string `toml:"vault_token"`
+	VaultRoleID      string `toml:"vault_role_id"`
+	VaultSecretID    string `toml:"vault_secret_id"`
+	VaultUsernameKey string `toml:"vault_username_key"`
+	VaultPasswordKey string `toml:"vault_password_key"`
+
+	tlsint.ClientConfig
+
+	PinnedCertSHA256 []string `toml:"pinned_cert_sha256"`
+
+	Socks5ProxyAddr string `toml:"socks5_proxy_addr"`
+	Socks5Username  string `toml:"socks5_username"`
+	Socks5Password  string `toml:"socks5_password"`
+
+	Resolver      string            `toml:"resolver"`
+	HostOverrides map[string]string `toml:"host_overrides"`
+
+	LocalAddress   string `toml:"local_address"`
+	LocalInterface string `toml:"local_interface"`
+
+	IPFamily string `toml:"ip_family"`
+
+	IdleConnTimeout   internal.Duration `toml:"idle_conn_timeout"`
+	MaxIdleConns      int               `toml:"max_idle_conns"`
+	DisableKeepAlives bool              `toml:"disable_keep_alives"`
+
+	ForceHTTP1 bool `toml:"force_http1"`
 
 	SuccessStatusCodes []int `toml:"success_status_codes"`
 
 	Timeout internal.Duration `toml:"timeout"`
 
+	MaxBodySize internal.Size `toml:"max_body_size"`
+
+	UserAgent  string   `toml:"user_agent"`
+	UserAgents []string `toml:"user_agents"`
+
+	MinLoginInterval     internal.Duration `toml:"min_login_interval"`
+	MinEffectiveInterval internal.Duration `toml:"min_effective_interval"`
+
 	HistoryInterval internal.Duration `toml:"history_interval"`
 
 	StartDate string `toml:"start_date"`
 
-	RunTestsOnly bool `toml:"run_tests_only"`
+	Timezone     string `toml:"timezone"`
+	EmitTimezone string `toml:"emit_timezone"`
+
+	LatestOnly bool `toml:"latest_only"`
+
+	ReadingType string `toml:"reading_type"`
+
+	Measurement       string `toml:"measurement"`
+	SplitMeasurements bool   `toml:"split_measurements"`
+
+	FillMissing string `toml:"fill_missing"`
+
+	SkipEmitted bool `toml:"skip_emitted"`
+
+	Schema string `toml:"schema"`
+
+	AlignTimestamps bool `toml:"align_timestamps"`
+
+	FieldInclude []string `toml:"fieldinclude"`
+	FieldExclude []string `toml:"fieldexclude"`
+
+	FieldRename map[string]string `toml:"field_rename"`
+	FieldTypes  map[string]string `toml:"field_types"`
+
+	Unit string `toml:"unit"`
+
+	ConsumptionField string `toml:"consumption_field"`
+
+	FloatPrecision int `toml:"float_precision"`
+
+	Formatted     bool   `toml:"formatted"`
+	FormattedPath string `toml:"formatted_path"`
+
+	Async             bool              `toml:"async"`
+	AsyncIDPath       string            `toml:"async_id_path"`
+	AsyncStatusPath   string            `toml:"async_status_path"`
+	AsyncPollInterval internal.Duration `toml:"async_poll_interval"`
+	AsyncTimeout      internal.Duration `toml:"async_timeout"`
+
+	TariffScheduleFile string  `toml:"tariff_schedule_file"`
+	TariffCycle        string  `toml:"tariff_cycle"`
+	Tariff             *Tariff `toml:"tariff"`
+	OMIE               *OMIE   `toml:"omie"`
+
+	Aggregates bool `toml:"aggregates"`
+	DailyPeak  bool `toml:"daily_peak"`
+
+	CumulativeCounter bool `toml:"cumulative_counter"`
+
+	DailyTotals         bool   `toml:"daily_totals"`
+	DailyTotalsPath     string `toml:"daily_totals_path"`
+	DailyTotalsDateKey  string `toml:"daily_totals_date_key"`
+	DailyTotalsValueKey string `toml:"daily_totals_value_key"`
+
+	MonthlyReadings     bool   `toml:"monthly_readings"`
+	MonthlyReadingsPath string `toml:"monthly_readings_path"`
+
+	QualityKey string `toml:"quality_key"`
+	SourceKey  string `toml:"source_key"`
+
+	PhaseKeys []string `toml:"phase_keys"`
+
+	DropEstimated bool `toml:"drop_estimated"`
+
+	IncludeInjection     bool   `toml:"include_injection"`
+	InjectionRequestType string `toml:"injection_request_type"`
+
+	UPAC             bool              `toml:"upac"`
+	UPACRequestTypes map[string]string `toml:"upac_request_types"`
+
+	MaxPower     bool   `toml:"max_power"`
+	MaxPowerPath string `toml:"max_power_path"`
+
+	RegisterReadings     bool   `toml:"register_readings"`
+	RegisterReadingsPath string `toml:"register_readings_path"`
+
+	RegisterDeltas   bool    `toml:"register_deltas"`
+	RegisterRollover float64 `toml:"register_rollover"`
+
+	Outages     bool   `toml:"outages"`
+	OutagesPath string `toml:"outages_path"`
+
+	PlannedOutages     bool   `toml:"planned_outages"`
+	PlannedOutagesPath string `toml:"planned_outages_path"`
+
+	ContractHistory     bool   `toml:"contract_history"`
+	ContractHistoryPath string `toml:"contract_history_path"`
+
+	CpeOverrides []*CpeOverride `toml:"cpe_override"`
+
+	PostProcessors []*PostProcessor `toml:"post_processor"`
+
+	HealthAddress string         `toml:"health_address"`
+	HealthTokens  []*HealthToken `toml:"health_token"`
+
+	StateFile  string `toml:"state_file"`
+	CookieFile string `toml:"cookie_file"`
+
+	CatchUpWindow      internal.Duration `toml:"catch_up_window"`
+	CatchUpMaxRequests int               `toml:"catch_up_max_requests"`
+
+	MaxConcurrentRequests int `toml:"max_concurrent_requests"`
+	MaxDailyRequests      int `toml:"max_daily_requests"`
+
+	TransformCommand []string          `toml:"transform_command"`
+	TransformTimeout internal.Duration `toml:"transform_timeout"`
+
+	// Set in Init unless already set, tests inject fakes here. The
+	// Authenticator and UsageFetcher are used for the top level account.
+	Client        HTTPDoer      `toml:"-"`
+	Authenticator Authenticator `toml:"-"`
+	UsageFetcher  UsageFetcher  `toml:"-"`
+
+	sessions []*session
+	vault    *vaultCredentials
+
+	snapshot     snapshotter
+	healthServer *http.Server
+
+	lastRun        time.Time
+	warnedInterval bool
+
+	startDate time.Time
+	overrides map[string]*CpeOverride
+
+	state *state
+
+	// Consecutive failed attempts per CPE, reported with the errors
+	attempts     map[string]int
+	attemptsLock sync.Mutex
+
+	// Supply points are gathered concurrently, the parser may not be safe
+	// to use concurrently
+	parserLock sync.Mutex
+
+	// Slots of the portal requests in flight, max_concurrent_requests
+	requests chan struct{}
 
-	client *http.Client
+	// Requests made, to rotate user_agents
+	userAgentIndex uint32
+
+	harvests   harvests
+	estimates  estimates
+	emitted    pendingEmitted
+	totals     pendingTotals
+	registers  pendingRegisters
+	aggregates aggregates
+
+	// ERSE tariff periods, built in or from tariff_schedule_file
+	tariffSchedules []tariffInterval
+
+	// Time zone of the request windows and the portal times
+	location *time.Location
+
+	// fieldinclude and fieldexclude, nil if not set
+	fieldFilter filter.Filter
 
 	// The parser will automatically be set by Telegraf core code because
 	// this plugin implements the ParserInput interface (i.e. the SetParser method)
 	parser parsers.Parser
 }
 
-var eredesSignIn = "https://online.e-redes.pt/listeners/api.php/ms/auth/auth/signin"
-var eredesUsage = "https://online.e-redes.pt/listeners/api.php/ms/reading/data-usage/sysgrid/get"
+// HTTPDoer sends the requests to the portal, usually an *http.Client
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Authenticator signs in to the portal and returns the bearer token
+type Authenticator interface {
+	SignIn() (string, error)
+}
+
+// Default endpoints. Constants, every instance resolves its own URLs so
+// instances with different accounts share nothing.
+const (
+	eredesSignIn           = "https://online.e-redes.pt/listeners/api.php/ms/auth/auth/signin"
+	eredesRefresh          = "https://online.e-redes.pt/listeners/api.php/ms/auth/auth/refresh"
+	eredesUsage            = "https://online.e-redes.pt/listeners/api.php/ms/reading/data-usage/sysgrid/get"
+	eredesUsageResult      = "https://online.e-redes.pt/listeners/api.php/ms/reading/data-usage/sysgrid/result"
+	eredesCpes             = "https://online.e-redes.pt/listeners/api.php/ms/contract/cpes/get"
+	eredesContract         = "https://online.e-redes.pt/listeners/api.php/ms/contract/contract/get"
+	eredesContractHistory  = "https://online.e-redes.pt/listeners/api.php/ms/contract/contract-history/get"
+	eredesMeter            = "https://online.e-redes.pt/listeners/api.php/ms/contract/meter/get"
+	eredesMonthlyReadings  = "https://online.e-redes.pt/listeners/api.php/ms/reading/readings/get"
+	eredesMaxPower         = "https://online.e-redes.pt/listeners/api.php/ms/reading/max-power/get"
+	eredesRegisterReadings = "https://online.e-redes.pt/listeners/api.php/ms/reading/registers/get"
+	eredesOutages          = "https://online.e-redes.pt/listeners/api.php/ms/outage/interruptions/get"
+	eredesPlannedOutages   = "https://online.e-redes.pt/listeners/api.php/ms/outage/planned-interruptions/get"
+)
+
+// User-Agent of the portal requests, a browser's as the portal expects
+const defaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Safari/605.1.15"
+
+// request_type of the usage request per reading_type
+var readingTypes = map[string]string{
+	"quarter_hourly": "3",
+	"daily":          "2",
+	"monthly":        "1",
+}
 
 var sampleConfig = `
   ## E-Redes Auth Credentials
@@ -61,13 +323,123 @@ var sampleConfig = `
   # password = "password"
   # cpe = "cpe"
 
+  ## Several supply points of the same account, gathered with the same
+  ## session. Metrics are tagged with the cpe.
+  # cpes = ["PT0002...", "PT0002..."]
+
+  ## Gather all the supply points of the account, listed from cpes_url after
+  ## sign in. The path selects the CPEs in the response (gjson syntax) and
+  ## can filter them, ex: Body.Result.#(active==true)#.cpe
+  # discover_cpes = false
+  # discover_cpes_path = "Body.Result.#.cpe"
+
+  ## Location of the token in the sign in and refresh responses and of the
+  ## readings in the usage response for the built-in parser (gjson syntax),
+  ## to follow changes of the portal envelope. Without data_json_path the
+  ## known envelopes of the usage response are tried in turn.
+  # token_json_path = "Body.Result.token"
+  # data_json_path = ""
+
+  ## Add the contract details of the supply point, fetched daily from
+  ## contract_url: tariff_option and voltage_level tags and the
+  ## contracted_power_kva field
+  # contract_metadata = false
+
+  ## Add the meter installed at the supply point, fetched daily from
+  ## meter_url: meter_serial, meter_brand and meter_model tags, to tell the
+  ## series apart when the meter is replaced
+  # meter_metadata = false
+
+  ## Read username and password from an AES-GCM encrypted file instead,
+  ## decrypted with the key in credentials_key_file (optional)
+  # encrypted_credentials_file = "/etc/telegraf/eredes.enc"
+  # credentials_key_file = "/etc/telegraf/eredes.key"
+
+  ## Read username and password from a HashiCorp Vault KV secret instead
+  ## (optional). Use either a token or AppRole auth. insecure_skip_verify
+  ## and the other TLS settings apply to the vault too.
+  # vault_address = "https://vault.example.com:8200"
+  # vault_path = "secret/data/eredes"
+  # vault_token = ""
+  # vault_role_id = ""
+  # vault_secret_id = ""
+  # vault_username_key = "username"
+  # vault_password_key = "password"
+
   # sign_in_url = "https://online.e-redes.pt/listeners/api.php/ms/auth/auth/signin"
+  # refresh_url = "https://online.e-redes.pt/listeners/api.php/ms/auth/auth/refresh"
   # usage_url = "https://online.e-redes.pt/listeners/api.php/ms/reading/data-usage/sysgrid/get"
+  # usage_result_url = "https://online.e-redes.pt/listeners/api.php/ms/reading/data-usage/sysgrid/result"
+  # cpes_url = "https://online.e-redes.pt/listeners/api.php/ms/contract/cpes/get"
+  # contract_url = "https://online.e-redes.pt/listeners/api.php/ms/contract/contract/get"
+  # contract_history_url = "https://online.e-redes.pt/listeners/api.php/ms/contract/contract-history/get"
+  # meter_url = "https://online.e-redes.pt/listeners/api.php/ms/contract/meter/get"
+  # monthly_readings_url = "https://online.e-redes.pt/listeners/api.php/ms/reading/readings/get"
+  # max_power_url = "https://online.e-redes.pt/listeners/api.php/ms/reading/max-power/get"
+  # register_readings_url = "https://online.e-redes.pt/listeners/api.php/ms/reading/registers/get"
+  # outages_url = "https://online.e-redes.pt/listeners/api.php/ms/outage/interruptions/get"
+  # planned_outages_url = "https://online.e-redes.pt/listeners/api.php/ms/outage/planned-interruptions/get"
   # insecure_skip_verify = true
 
+  ## SHA-256 fingerprints of the accepted server certificates (optional), of
+  ## the server certificate or of one of its chain (ex: the intermediate CA)
+  ## Checked in addition to the normal TLS verification
+  # pinned_cert_sha256 = ["AB:CD:..."]
+
+  ## SOCKS5 proxy the portal requests go through (optional), with the
+  ## username and password if it requires them. The proxy resolves the
+  ## portal hosts: resolver then only resolves the proxy, host_overrides
+  ## still applies and ip_family can't be set.
+  # socks5_proxy_addr = "127.0.0.1:1080"
+  # socks5_username = ""
+  # socks5_password = ""
+
+  ## DNS server resolving the portal hosts instead of the system's (ex: when
+  ## split-horizon DNS or a DNS blocker breaks them), port 53 if not given
+  # resolver = "1.1.1.1:53"
+
+  ## Address the portal connections leave from, for multi-homed hosts, or
+  ## the interface whose address is used (IPv4 if it has one)
+  # local_address = "192.0.2.10"
+  # local_interface = "wan1"
+
+  ## IP version of the portal connections: ipv4, ipv6 or any, to avoid an
+  ## unreliable IPv6 route
+  # ip_family = "any"
+
+  ## Connection reuse: how long an idle connection is kept, how many are
+  ## kept (0 is the Go default) and whether they're reused at all. With a
+  ## long interval, disable_keep_alives avoids holding them for hours.
+  # idle_conn_timeout = "90s"
+  # max_idle_conns = 0
+  # disable_keep_alives = false
+
+  ## Don't negotiate HTTP/2 with the portal, for troubleshooting when its
+  ## CDN misbehaves over HTTP/2
+  # force_http1 = false
+
   ## Amount of time allowed to complete the HTTP request (default is 60s)
   # timeout = "60s"
 
+  ## Maximum size of a portal response, decompressed. Larger ones (ex: an
+  ## error page of a proxy) fail the request instead of being read whole.
+  # max_body_size = "64MB"
+
+  ## User-Agent header of the portal requests, to change it if the portal
+  ## starts rejecting the default one (a Safari browser)
+  # user_agent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Safari/605.1.15"
+
+  ## User-Agent headers used in turn, one per request, instead of user_agent
+  # user_agents = []
+
+  ## Minimum time between sign in attempts, protects the account from the
+  ## portal failed login lockout (default is 10m)
+  # min_login_interval = "10m"
+
+  ## Cycles closer than this to the previous one are skipped, the API
+  ## publishes daily (default is 1h)
+  # min_effective_interval = "1h"
+
   # Interval to request until start of current day
   # Minimum is 24h
   # Ex: 24h = last 24h = yesterday 00:00 to 23:59
@@ -77,6 +449,388 @@ var sampleConfig = `
   # If range is defined, first request will fetch this range and then
   # proceed with interval
   # start_date = "2020-12-31 23:59:59"
+
+  ## Time zone of the requested days, start_date and the portal times
+  ## without a zone, independent of the host's
+  # timezone = "Europe/Lisbon"
+
+  ## Timestamps of the metrics: utc writes the instant of the reading, local
+  ## its wall clock time in timezone as if it were UTC, to line up with
+  ## series written that way
+  # emit_timezone = "utc"
+
+  ## Only request the latest day (the current month with monthly
+  ## reading_type) every cycle, ignoring history_interval, start_date and
+  ## the gaps since the last reading. Smallest requests, for checking that
+  ## yesterday's readings arrived.
+  # latest_only = false
+
+  ## Granularity of the readings: quarter_hourly (load curve), daily or
+  ## monthly. Monthly readings are requested from the start of the month.
+  # reading_type = "quarter_hourly"
+
+  ## Measurement of the readings, instead of the parser's (ex: eredes with
+  ## the built-in parser). measurement in cpe_override takes precedence.
+  # measurement = "eredes_consumption"
+
+  ## Write each kind of reading to its own measurement instead of mixing
+  ## them: eredes_curve (quarter_hourly), eredes_daily, eredes_monthly,
+  ## eredes_injection and eredes_upac (flows). The daily totals and monthly
+  ## readings series already have theirs, like the max power
+  ## (eredes_maxpower). measurement wins.
+  # split_measurements = false
+
+  ## Fields of the parsed readings kept (glob patterns), before the reading
+  ## is built (optional). quality_key is always kept.
+  # fieldinclude = ["meterLoadCurve"]
+  # fieldexclude = []
+
+  ## Unit of the energy fields. With kwh, the numeric fields of the parsed
+  ## readings in Wh are divided by 1000 and get a _kwh suffix (ex: a_plus
+  ## becomes a_plus_kwh). The load curve is in kWh already (the formatted
+  ## variant shows "0,125 kWh"), so meterLoadCurve, kwh of the built-in
+  ## parser and _kwh fields are left as they are. Empty keeps them as
+  ## received.
+  # unit = ""
+
+  ## Field of the parsed readings with the consumption in kWh, the energy
+  ## the costs, counters and aggregates are computed from (optional). The
+  ## default is kwh with the built-in parser or transform_command, and
+  ## meterLoadCurve with data_format. A reading without it fails the window.
+  # consumption_field = ""
+
+  ## Decimals the float fields of the readings are rounded to, to avoid
+  ## 0.12300000000000001 like values. 0 keeps them as they are.
+  # float_precision = 0
+
+  ## Emit a point for each period missing from the readings, with a missing
+  ## field, so charts don't interpolate across the holes: null leaves out
+  ## the kwh field, zero sets it to 0. The periods are filled from the start
+  ## of the window to the end of the last day with readings, in the series
+  ## (measurement and tags) of the reading before them. Not for monthly
+  ## readings, and only zero with the home_assistant schema.
+  # fill_missing = "none"
+
+  ## Skip the readings at or before the newest one already emitted of the
+  ## CPE (kept in the state file), so overlapping windows never write a
+  ## reading twice. Estimated readings aren't replaced by the real ones,
+  ## unless drop_estimated is set.
+  # skip_emitted = false
+
+  ## Round the quarter-hour reading timestamps to the nearest quarter-hour,
+  ## for responses with stray seconds that would give near duplicate points
+  # align_timestamps = false
+
+  ## Write the readings like another tool expects them. home_assistant
+  ## writes them like the Home Assistant InfluxDB integration writes an
+  ## energy sensor: a kWh measurement with domain and entity_id (ex:
+  ## eredes_house) tags and a value field, the consumption running total
+  ## (cumulative_counter is enabled) with state_class_str total_increasing.
+  ## Other directions get their kwh as value.
+  # schema = ""
+
+  ## Request the formatted variant of the usages, more stable when the raw
+  ## one changes. Only the readings selected by the path (gjson syntax) are
+  ## given to the parser or transform_command, so json_query selects within
+  ## them ("" if they're the array of readings). The built-in parser reads
+  ## both variants into the same fields.
+  # formatted = false
+  # formatted_path = "Body.Result.formattedData"
+
+  ## Request the usages with wait=false, for ranges that time out while the
+  ## portal prepares them. The job id in the response (async_id_path) is
+  ## polled at usage_result_url, waiting twice as long each time up to 1m,
+  ## while its status (async_status_path) is pending, processing or running.
+  ## A failed or error status is reported and the request submitted again
+  ## next time.
+  ## Polls count towards max_daily_requests, which reserves the most polls
+  ## a job can take before async_timeout. The job id is kept in state_file
+  ## until its result arrives, so after a restart or a timeout the job is
+  ## polled again instead of submitted again (for up to a day).
+  # async = false
+  # async_id_path = "Body.Result.requestId"
+  # async_status_path = "Body.Result.status"
+  # async_poll_interval = "5s"
+  # async_timeout = "5m"
+
+  ## Field or tag of the parsed readings with the portal quality flag, added
+  ## as the quality tag (real or estimated) instead. With the json parser it
+  ## has to be in json_string_fields or tag_keys to be kept.
+  # quality_key = "loadCurveQuality"
+
+  ## Field or tag of the parsed readings telling remote telemetry from
+  ## manual readings submitted by the customer, added as the source tag
+  ## (telemetry or manual) instead. Kept like quality_key.
+  # source_key = ""
+
+  ## Fields of the parsed readings with the per-phase values of three-phase
+  ## supply points, emitted as the l1, l2 and l3 fields instead. Readings
+  ## without them are left as they are.
+  ## With the json parser they have to be in json_string_fields.
+  # phase_keys = ["meterLoadCurveL1", "meterLoadCurveL2", "meterLoadCurveL3"]
+
+  ## Skip the readings flagged as estimated. The watermark is held back so
+  ## they're requested again until real readings replace them, for up to 7
+  ## days.
+  # drop_estimated = false
+
+  ## Also request the energy injected into the grid (ex: solar panels),
+  ## emitted like the consumption. Readings are then tagged with direction
+  ## consumption or injection. The injection curve is requested with
+  ## injection_request_type.
+  # include_injection = false
+  # injection_request_type = "4"
+
+  ## Also request the flows of a self-consumption unit (UPAC): energy
+  ## produced, self-consumed and injected into the grid, emitted like the
+  ## consumption with a flow tag. include_injection isn't needed with it.
+  ## The request type of each flow can be changed in upac_request_types.
+  # upac = false
+
+  ## Emit the daily and weekly totals of the quarter-hour consumption as
+  ## eredes_daily_aggregate and eredes_weekly (from Monday), with kwh and
+  ## avg_power_kw fields and the number of points or days they have. The
+  ## daily one isn't named eredes_daily, that's the portal's daily totals
+  ## (daily_totals). A week is emitted once all its days are known, the
+  ## daily totals of the last two weeks are kept in state_file.
+  # aggregates = false
+
+  ## Emit the highest quarter-hour average power of each day as
+  ## eredes_daily_peak, with peak_kw and peak_at (unix time) fields, to see
+  ## how close it gets to the contracted power.
+  # daily_peak = false
+
+  ## Add a consumption_total_kwh field to the consumption readings, a running
+  ## total kept in the state file, for tools that expect an energy counter.
+  ## Readings requested again aren't counted twice.
+  # cumulative_counter = false
+
+  ## Also request the daily totals series, once a day, and emit it as
+  ## eredes_daily, one point per day with a kwh field. The path selects the days in the
+  ## response (gjson syntax), the keys their date and value.
+  # daily_totals = false
+  # daily_totals_path = "Body.Result.utilitiesDevices.0.dailyConsumptions"
+  # daily_totals_date_key = "date"
+  # daily_totals_value_key = "consumption"
+
+  ## Also request the billing cycle readings (leituras) of the last 13
+  ## months from monthly_readings_url, once a day, and emit them as
+  ## eredes_monthly with a kwh field and period_start and period_end tags.
+  ## The path selects the readings in the response (gjson syntax), each with
+  ## startDate, endDate and consumption keys.
+  # monthly_readings = false
+  # monthly_readings_path = "Body.Result.readings"
+
+  ## Also request the maximum quarter-hour power (potência tomada) per day
+  ## from max_power_url, once a day, and emit it as eredes_maxpower with a
+  ## max_power_kw field, to check if the contracted power is adequate. The
+  ## path selects the days in the response (gjson syntax), each with
+  ## maxPower and date or timestamp (time of the peak) keys.
+  # max_power = false
+  # max_power_path = "Body.Result.maxPowers"
+
+  ## Also request the cumulative meter register readings (totalizadores)
+  ## once a day and emit them as the eredes_register counter, with a field
+  ## per register (ex: vazio_kwh), to cross-check against the meter display.
+  ## The path selects the readings in the response (gjson syntax), each with
+  ## register, value and timestamp keys.
+  # register_readings = false
+  # register_readings_path = "Body.Result.registers"
+
+  ## Add the consumption since the previous reading of each register (ex:
+  ## vazio_delta_kwh), kept in the state file. A register that goes down
+  ## rolled over at register_rollover (ex: 1000000 for a 6 digit display)
+  ## when it's set, otherwise the meter was replaced and no delta is added.
+  # register_deltas = false
+  # register_rollover = 0.0
+
+  ## Also request the supply interruptions once a day and emit them as
+  ## eredes_outages at their start, with duration_s and end (or ongoing)
+  ## fields and a cause tag. The path selects the interruptions in the
+  ## response (gjson syntax), each with startDate, endDate or duration, and
+  ## causeCode keys.
+  # outages = false
+  # outages_path = "Body.Result.interruptions"
+
+  ## Also request the planned interruptions of the next 30 days once a day
+  ## and emit them as eredes_planned_outages, dated at their future start,
+  ## with duration_s and end fields and description and window tags (ex: to
+  ## charge batteries before). The path selects the interruptions in the
+  ## response (gjson syntax), each with startDate, endDate and description
+  ## keys.
+  # planned_outages = false
+  # planned_outages_path = "Body.Result.plannedInterruptions"
+
+  ## Also request the contracted power changes once a day and emit them as
+  ## eredes_contracted_power, one point at each change with the new
+  ## contracted_power_kva field and a tariff_option tag, to overlay upgrades
+  ## on the consumption. The path selects the changes in the response (gjson
+  ## syntax), each with startDate, contractedPower and tariffOption keys.
+  # contract_history = false
+  # contract_history_path = "Body.Result.contractChanges"
+
+  ## ERSE tariff periods replacing the built in ones, for when the schedules
+  ## change before a new release (optional). CSV with the columns
+  ## cycle,season,days,start,end,period, like tariffs.csv in the source.
+  # tariff_schedule_file = "/etc/telegraf/eredes-tariffs.csv"
+
+  ## Tariff cycle of the contract, daily or weekly. Quarter-hour readings
+  ## are then tagged with their tariff_period (vazio, cheias or ponta) at
+  ## the reading timestamp (optional).
+  # tariff_cycle = ""
+
+  ## File to store the last gathered date, so gaps (ex: agent downtime) are
+  ## fetched automatically on the next cycles (optional)
+  # state_file = "/var/lib/telegraf/eredes.json"
+
+  ## File to keep the portal session cookies between restarts (optional),
+  ## with their path and expiry. Expired cookies aren't restored.
+  # cookie_file = "/var/lib/telegraf/eredes_cookies.json"
+
+  ## Maximum range per request and number of requests per cycle when
+  ## catching up
+  # catch_up_window = "168h"
+  # catch_up_max_requests = 2
+
+  ## Number of portal requests at the same time, across supply points
+  ## (default is 1). The catch up windows of a supply point are always
+  ## requested in order. Keep it at 1 on slow links or to go easy on the
+  ## portal.
+  # max_concurrent_requests = 1
+
+  ## Cap of portal requests per day, 0 is no cap (optional). Two requests
+  ## are kept for the sign in of the next cycle, the rest are allocated by
+  ## priority (latest readings, daily requests, contract details, backfill)
+  ## and what doesn't fit is deferred to the next cycles. Sign in stops
+  ## when the cap is reached.
+  # max_daily_requests = 0
+
+  ## Command converting the raw usage response instead of the parser, for
+  ## when the portal changes faster than releases (optional). It gets the
+  ## response on stdin and writes a JSON array of readings to stdout:
+  ##   [{"v": 1, "ts": "2021-01-15T12:15:00Z", "kwh": 0.125}]
+  ## Optional keys: register, quality, source. The readings are processed
+  ## like the parsed ones, for the CPE and direction requested. It runs with
+  ## an empty environment in a temporary directory and is killed after
+  ## transform_timeout with its children, but it's not a sandbox: it runs
+  ## as the Telegraf user, with its access to files and network.
+  # transform_command = ["/usr/local/bin/eredes-transform"]
+  # transform_timeout = "10s"
+
+  ## Data format of the usage responses (optional). Without it the built-in
+  ## parser reads the load curve into eredes metrics with a kwh field, at
+  ## the reading timestamp (in timezone unless it has a zone).
+  ## https://github.com/influxdata/telegraf/blob/master/docs/DATA_FORMATS_INPUT.md
+  # data_format = "json"
+
+  ## Address of the health endpoint (GET /health), reports the plugin state
+  ## as JSON with status 503 when unhealthy (optional)
+  # health_address = "localhost:9790"
+
+  ## Tags added to every metric of the plugin, readings and status alike
+  ## (optional). Standard Telegraf input option, no processor needed.
+  # [inputs.eredes.tags]
+  #   site = "lisbon"
+
+  ## Friendly names of the supply points, added as a name tag (optional)
+  # [inputs.eredes.cpe_aliases]
+  #   "PT0002..." = "house"
+
+  ## Fields of the readings renamed when emitted, after the contract and cost
+  ## fields are added (optional)
+  # [inputs.eredes.field_rename]
+  #   meterLoadCurve = "consumption_kwh"
+
+  ## Type of the emitted fields, float or int, after field_rename
+  ## (optional). Avoids field type conflicts when the portal alternates
+  ## between "123" and "123.0".
+  # [inputs.eredes.field_types]
+  #   consumption_kwh = "float"
+
+  ## request_type of the UPAC flows (optional)
+  # [inputs.eredes.upac_request_types]
+  #   produced = "5"
+  #   self_consumed = "6"
+  #   injected = "4"
+
+  ## IP of portal hosts, instead of resolving them (optional). The
+  ## certificate is still checked against the host name.
+  # [inputs.eredes.host_overrides]
+  #   "online.e-redes.pt" = "203.0.113.10"
+
+  ## Prices of the contract, to add an estimated_cost_eur field to the
+  ## consumption readings and emit the cost of each day, with the fixed
+  ## daily_charge, as eredes_cost (optional). Readings are priced by their
+  ## tariff_period, or with simple if they have none. For a bi-hourly
+  ## tariff, set cheias and ponta to the fora de vazio price. Without
+  ## taxes, they aren't included. With taxes, the daily cost includes IVA
+  ## (reduced on the first reduced_iva_kwh per 30 days, and on daily_charge
+  ## with reduced_iva_daily_charge), IEC per kWh and the monthly DGEG fee
+  ## and CAV, spread over the days, and they're also emitted as taxes_eur.
+  # [inputs.eredes.tariff]
+  #   simple = 0.1658
+  #   vazio = 0.0967
+  #   cheias = 0.1707
+  #   ponta = 0.2286
+  #   daily_charge = 0.3205
+  # [inputs.eredes.tariff.taxes]
+  #   iva = 0.23
+  #   reduced_iva = 0.06
+  #   reduced_iva_kwh = 100.0
+  #   reduced_iva_daily_charge = false
+  #   iec = 0.001
+  #   dgeg = 0.07
+  #   cav = 2.85
+
+  ## Join the consumption with the OMIE day-ahead prices, for indexed
+  ## tariffs (optional). Emitted per market period (hourly, or quarter
+  ## hourly since the market moved to quarter-hour prices) as eredes_omie
+  ## with kwh, price_eur_mwh (of the period) and cost_eur fields, the cost
+  ## of a kWh being price / 1000 * factor + margin. Only quarter-hour
+  ## readings are joined. The prices are downloaded through the SOCKS5 proxy,
+  ## dialer and TLS settings of the portal, without the certificate pins,
+  ## and a day not published yet is requested again after an hour.
+  # [inputs.eredes.omie]
+  #   url = "https://www.omie.es/es/file-download?parents%5B0%5D=marginalpdbcpt&filename=marginalpdbcpt_{date}.1"
+  #   factor = 1.0
+  #   margin = 0.0
+
+  ## Other portal accounts, each with its own session (optional)
+  # [[inputs.eredes.account]]
+  #   username = "landlord@example.com"
+  #   password = "password"
+  #   cpes = ["PT0002..."]
+  #   discover_cpes = false
+
+  ## Requested range and measurement of a supply point, if different (optional)
+  # [[inputs.eredes.cpe_override]]
+  #   cpe = "PT0002..."
+  #   start_date = "2021-01-15 00:00:00"
+  #   history_interval = "24h"
+  #   measurement = "eredes_house"
+  #   final_harvest = false
+  #   tariff_cycle = "weekly"
+
+  ## Tokens allowed on the health endpoint, sent as "Authorization: Bearer"
+  ## (optional). Without tokens the endpoint is open. A token with cpes only
+  ## gets the data of those supply points (ex: a tenant's own CPE).
+  # [[inputs.eredes.health_token]]
+  #   token = "secret"
+  # [[inputs.eredes.health_token]]
+  #   token = "tenant-secret"
+  #   cpes = ["PT0002..."]
+
+  ## Processing applied in order to the readings before they're emitted, for
+  ## noisy meters (optional). Types: median (window, the readings without a
+  ## full window around them are kept), clamp (min and/or max) and scale
+  ## (factor, integer fields are rounded). Applies to all numeric fields
+  ## unless fields is set.
+  # [[inputs.eredes.post_processor]]
+  #   type = "median"
+  #   window = 3
+  # [[inputs.eredes.post_processor]]
+  #   type = "clamp"
+  #   max = 10.0
 `
 
 // SampleConfig returns the default configuration of the Input
@@ -97,123 +851,973 @@ func (eredes *EREDES) Init() error {
 		return err
 	}
 
-	transport := &http.Transport{
-		TLSClientConfig: tlsCfg,
+	if len(eredes.PinnedCertSHA256) > 0 {
+		pins, err := parsePinnedCerts(eredes.PinnedCertSHA256)
+		if err != nil {
+			return err
+		}
+		if tlsCfg == nil {
+			tlsCfg = &tls.Config{}
+		}
+		tlsCfg.VerifyPeerCertificate = verifyPinnedCert(pins)
+	}
+
+	dial, err := eredes.dialer()
+	if err != nil {
+		return err
 	}
 
-	eredes.client = &http.Client{
-		Transport: transport,
-		Timeout:   eredes.Timeout.Duration,
+	transport := &http.Transport{
+		TLSClientConfig:   tlsCfg,
+		DialContext:       dial,
+		IdleConnTimeout:   eredes.IdleConnTimeout.Duration,
+		DisableKeepAlives: eredes.DisableKeepAlives,
+		// A custom dialer or TLS config turns HTTP/2 off unless asked for
+		ForceAttemptHTTP2: !eredes.ForceHTTP1,
+	}
+	if eredes.ForceHTTP1 {
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	if eredes.MaxIdleConns > 0 {
+		// All the requests go to the portal, so per host is the same
+		transport.MaxIdleConns = eredes.MaxIdleConns
+		transport.MaxIdleConnsPerHost = eredes.MaxIdleConns
 	}
 
 	eredes.SuccessStatusCodes = []int{200}
+
+	if eredes.Timezone == "" {
+		eredes.Timezone = "Europe/Lisbon"
+	}
+	eredes.location, err = time.LoadLocation(eredes.Timezone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone: %s", err)
+	}
+
+	switch eredes.EmitTimezone {
+	case "", "utc", "local":
+	default:
+		return fmt.Errorf("invalid emit_timezone %q, expected utc or local", eredes.EmitTimezone)
+	}
+
+	if eredes.StartDate != "" {
+		eredes.startDate, err = time.ParseInLocation("2006-01-02 15:04:05", eredes.StartDate, eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid start_date: %s", err)
+		}
+	}
+
+	if eredes.ReadingType == "" {
+		eredes.ReadingType = "quarter_hourly"
+	}
+	if _, ok := readingTypes[eredes.ReadingType]; !ok {
+		return fmt.Errorf("invalid reading_type %q, expected quarter_hourly, daily or monthly", eredes.ReadingType)
+	}
+
+	switch eredes.FillMissing {
+	case "", "none", "null", "zero":
+	default:
+		return fmt.Errorf("invalid fill_missing %q, expected none, null or zero", eredes.FillMissing)
+	}
+
+	switch eredes.Schema {
+	case "":
+	case "home_assistant":
+		eredes.CumulativeCounter = true
+		// Home Assistant entities need a value
+		if eredes.FillMissing == "null" {
+			return fmt.Errorf("fill_missing = \"null\" can't be used with schema = \"home_assistant\", use zero")
+		}
+	default:
+		return fmt.Errorf("invalid schema %q, expected home_assistant", eredes.Schema)
+	}
+
+	if err := eredes.initUPAC(); err != nil {
+		return err
+	}
+
+	if eredes.Unit != "" && eredes.Unit != "kwh" {
+		return fmt.Errorf("invalid unit %q, expected kwh", eredes.Unit)
+	}
+
+	for key, fieldType := range eredes.FieldTypes {
+		if fieldType != "float" && fieldType != "int" {
+			return fmt.Errorf("invalid type %q of %s in field_types, expected float or int", fieldType, key)
+		}
+	}
+
+	if len(eredes.FieldInclude) > 0 || len(eredes.FieldExclude) > 0 {
+		eredes.fieldFilter, err = filter.NewIncludeExcludeFilter(eredes.FieldInclude, eredes.FieldExclude)
+		if err != nil {
+			return fmt.Errorf("fieldinclude/fieldexclude: %s", err)
+		}
+	}
+
+	if eredes.UserAgent == "" {
+		eredes.UserAgent = defaultUserAgent
+	}
+	if eredes.TokenJSONPath == "" {
+		eredes.TokenJSONPath = "Body.Result.token"
+	}
+	if err := eredes.initPhases(); err != nil {
+		return err
+	}
+	if defaultParser(eredes.parser) {
+		eredes.parser, err = newBuiltinParser(eredes.DataJSONPath, eredes.QualityKey, eredes.SourceKey, eredes.PhaseKeys, eredes.location)
+		if err != nil {
+			return err
+		}
+	}
+	if eredes.ConsumptionField == "" {
+		eredes.ConsumptionField = "meterLoadCurve"
+		if _, ok := eredes.parser.(*builtinParser); ok || len(eredes.TransformCommand) > 0 {
+			eredes.ConsumptionField = "kwh"
+		}
+	}
+
+	eredes.tariffSchedules = erseTariffSchedules
+	if eredes.TariffScheduleFile != "" {
+		eredes.tariffSchedules, err = loadTariffSchedules(eredes.TariffScheduleFile)
+		if err != nil {
+			return fmt.Errorf("tariff_schedule_file: %s", err)
+		}
+	}
+
+	if !validTariffCycle(eredes.TariffCycle) {
+		return fmt.Errorf("invalid tariff_cycle %q, expected daily or weekly", eredes.TariffCycle)
+	}
+
+	eredes.overrides = make(map[string]*CpeOverride)
+	for _, o := range eredes.CpeOverrides {
+		if err := o.init(eredes.location); err != nil {
+			return err
+		}
+		eredes.overrides[o.Cpe] = o
+	}
+
+	eredes.attempts = make(map[string]int)
+	eredes.snapshot.setState(stateStarting)
+
+	for _, p := range eredes.PostProcessors {
+		if err := p.init(); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range eredes.HealthTokens {
+		if t.Token == "" {
+			return fmt.Errorf("health_token: token is required")
+		}
+	}
+
+	if eredes.EncryptedCredentialsFile != "" {
+		if eredes.CredentialsKeyFile == "" {
+			return fmt.Errorf("credentials_key_file is required when using encrypted_credentials_file")
+		}
+
+		credentials, err := decryptCredentials(eredes.EncryptedCredentialsFile, eredes.CredentialsKeyFile)
+		if err != nil {
+			return fmt.Errorf("error reading encrypted_credentials_file: %s", err)
+		}
+		eredes.Username = credentials.Username
+		eredes.Password = credentials.Password
+	}
+
+	if eredes.VaultAddress != "" {
+		if eredes.VaultPath == "" {
+			return fmt.Errorf("vault_path is required when using vault_address")
+		}
+		if eredes.VaultToken == "" && (eredes.VaultRoleID == "" || eredes.VaultSecretID == "") {
+			return fmt.Errorf("vault_token or vault_role_id and vault_secret_id are required when using vault_address")
+		}
+
+		// The TLS settings apply to the vault too, the certificate pins are
+		// only for the portal
+		vaultTLS, err := eredes.ClientConfig.TLSConfig()
+		if err != nil {
+			return err
+		}
+
+		eredes.vault = &vaultCredentials{
+			address:     eredes.VaultAddress,
+			path:        eredes.VaultPath,
+			token:       eredes.VaultToken,
+			roleID:      eredes.VaultRoleID,
+			secretID:    eredes.VaultSecretID,
+			usernameKey: eredes.VaultUsernameKey,
+			passwordKey: eredes.VaultPasswordKey,
+			client: &http.Client{
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: vaultTLS,
+				},
+				Timeout: eredes.Timeout.Duration,
+			},
+		}
+	}
+
+	if eredes.OMIE != nil {
+		// The certificate pins are only for the portal
+		omieTransport := transport.Clone()
+		if omieTransport.TLSClientConfig != nil {
+			omieTransport.TLSClientConfig.VerifyPeerCertificate = nil
+		}
+		eredes.OMIE.init(omieTransport, eredes.Timeout.Duration)
+	}
+
+	if err := eredes.initSessions(transport); err != nil {
+		return err
+	}
+
+	if eredes.CatchUpMaxRequests < 1 {
+		eredes.CatchUpMaxRequests = 1
+	}
+
+	if eredes.MaxConcurrentRequests < 1 {
+		eredes.MaxConcurrentRequests = 1
+	}
+	eredes.requests = make(chan struct{}, eredes.MaxConcurrentRequests)
+
+	if eredes.TransformTimeout.Duration <= 0 {
+		eredes.TransformTimeout.Duration = 10 * time.Second
+	}
+	if eredes.AsyncPollInterval.Duration <= 0 {
+		eredes.AsyncPollInterval.Duration = 5 * time.Second
+	}
+	if eredes.AsyncTimeout.Duration <= 0 {
+		eredes.AsyncTimeout.Duration = 5 * time.Minute
+	}
+
+	// In containers, keep the files in the declared volume unless set
+	if dir := os.Getenv("EREDES_STATE_DIR"); dir != "" {
+		if eredes.StateFile == "" {
+			eredes.StateFile = filepath.Join(dir, "state.json")
+		}
+		if eredes.CookieFile == "" {
+			eredes.CookieFile = filepath.Join(dir, "cookies.json")
+		}
+	}
+
+	eredes.state, err = loadState(eredes.StateFile)
+	if err != nil {
+		return fmt.Errorf("error loading state: %s", err)
+	}
+
+	return nil
+}
+
+// Create a session per account. The top level credentials are an account
+// too, unless only [[inputs.eredes.account]] are configured.
+func (eredes *EREDES) initSessions(transport http.RoundTripper) error {
+	eredes.sessions = nil
+
+	topLevel := len(eredes.Accounts) == 0 || eredes.Username != "" || eredes.vault != nil || eredes.Authenticator != nil
+	if topLevel {
+		name := eredes.Username
+		if name == "" {
+			name = "default"
+		}
+
+		s, err := newSession(eredes, name, eredes.Username, eredes.Password, append([]string{eredes.Cpe}, eredes.Cpes...), eredes.DiscoverCpes, transport)
+		if err != nil {
+			return err
+		}
+		s.vault = eredes.vault
+		if eredes.Authenticator != nil {
+			s.authenticator = eredes.Authenticator
+		}
+		if eredes.UsageFetcher != nil {
+			s.fetcher = eredes.UsageFetcher
+		}
+		eredes.sessions = append(eredes.sessions, s)
+	}
+
+	for _, account := range eredes.Accounts {
+		if account.Username == "" {
+			return fmt.Errorf("username is required in [[inputs.eredes.account]]")
+		}
+
+		s, err := newSession(eredes, account.Username, account.Username, account.Password, account.Cpes, account.DiscoverCpes, transport)
+		if err != nil {
+			return err
+		}
+		eredes.sessions = append(eredes.sessions, s)
+	}
+
+	for _, s := range eredes.sessions {
+		if len(s.cpes) == 0 && !s.discover {
+			return fmt.Errorf("account %s: cpe, cpes or discover_cpes is required", s.name)
+		}
+
+		if err := eredes.loadCookies(s); err != nil {
+			log.Printf("[eredes] error loading cookies: %s", err)
+		}
+	}
+
 	return nil
 }
 
 // Gather takes in an accumulator and adds the metrics that the Input
 // gathers. This is called every "interval"
 func (eredes *EREDES) Gather(acc telegraf.Accumulator) error {
-	token, err := eredes.signIn()
-	if err != nil {
-		acc.AddError(fmt.Errorf("[signIn]: %s", err))
+	// The API publishes daily, short intervals only get the account
+	// throttled. Allow some slack so a 1h interval with jitter still runs.
+	sinceLastRun := time.Since(eredes.lastRun)
+	if !eredes.lastRun.IsZero() && sinceLastRun < eredes.MinEffectiveInterval.Duration-time.Minute {
+		if !eredes.warnedInterval {
+			log.Printf("[eredes] interval is shorter than min_effective_interval (%s), skipping cycles", eredes.MinEffectiveInterval.Duration)
+			eredes.warnedInterval = true
+		}
 		return nil
 	}
+	eredes.lastRun = time.Now()
 
-	if token != "" {
-		err = eredes.gatherUsages(acc, token)
-		if err != nil {
-			acc.AddError(fmt.Errorf("Error in : %s", err))
-			return nil
+	if eredes.EmitTimezone == "local" {
+		acc = &localAccumulator{Accumulator: acc, location: eredes.location}
+	}
+
+	// Accounts and their CPEs are gathered independently, an error in one
+	// doesn't stop the others
+	var lastErr error
+	for _, s := range eredes.sessions {
+		for _, err := range eredes.gatherAccount(acc, s) {
+			acc.AddError(err)
+			lastErr = err
 		}
 	}
 
+	if err := eredes.saveCookies(); err != nil {
+		log.Printf("[eredes] error saving cookies: %s", err)
+	}
+
+	eredes.snapshot.recordGather(lastErr)
+	eredes.snapshot.setState(stateAfter(lastErr))
+	eredes.addStatus(acc)
+
 	return nil
 }
 
+// Returns the errors of the account, one per failed CPE
+func (eredes *EREDES) gatherAccount(acc telegraf.Accumulator, s *session) []error {
+	eredes.snapshot.setState(stateAuthenticating)
+	token, err := s.authenticator.SignIn()
+	s.passwordExpired = errors.Is(err, errPasswordExpired)
+	if err != nil {
+		s.signInAttempts++
+		err = &requestError{
+			account:  s.name,
+			cpe:      strings.Join(s.allCpes(), ","),
+			endpoint: eredes.signInURL(),
+			attempt:  s.signInAttempts,
+			err:      err,
+		}
+		for _, cpe := range s.allCpes() {
+			eredes.snapshot.recordCpe(cpe, err)
+		}
+		return []error{fmt.Errorf("[signIn]: %w", err)}
+	}
+	s.signInAttempts = 0
+
+	if token == "" {
+		return nil
+	}
+
+	var errs []error
+	for _, err := range eredes.gatherUsages(acc, s, token) {
+		errs = append(errs, fmt.Errorf("[gatherUsages]: %w", err))
+	}
+	return errs
+}
+
 // SetParser takes the data_format from the config and finds the right parser for that format
 func (eredes *EREDES) SetParser(parser parsers.Parser) {
 	eredes.parser = parser
 }
 
-// Gathers data from a particular URL
-// Parameters:
-//     acc    : The telegraf Accumulator to use
-//     url    : endpoint to send request to
-//
-// Returns:
-//     error: Any error that may have occurred
+// Gather every CPE of the session. A failed CPE doesn't stop the others,
+// and only the successful ones advance their watermark.
 func (eredes *EREDES) gatherUsages(
 	acc telegraf.Accumulator,
+	s *session,
+	token string,
+) []error {
+
+	log.Printf("[eredes] starting %s", s.name)
+
+	if s.discover && time.Since(s.discoveredAt) > 24*time.Hour {
+		cpes, err := s.discoverCpes(token)
+		if err != nil {
+			err = &requestError{
+				account:  s.name,
+				cpe:      strings.Join(s.allCpes(), ","),
+				endpoint: eredes.cpesURL(),
+				attempt:  1,
+				err:      err,
+			}
+			// Still gather the configured and previously discovered ones
+			if len(s.allCpes()) == 0 {
+				return []error{err}
+			}
+			acc.AddError(fmt.Errorf("[discoverCpes]: %w", err))
+		} else {
+			s.discoveredCpes = cpes
+			s.discoveredAt = time.Now()
+		}
+	}
+
+	// Supply points are gathered concurrently, sharing the session token.
+	// The portal requests are limited by max_concurrent_requests.
+	cpes := s.allCpes()
+	plans := eredes.planRequests(s, cpes)
+	errs := make(chan error, len(cpes))
+	var wg sync.WaitGroup
+	for _, cpe := range cpes {
+		wg.Add(1)
+		go func(cpe string) {
+			defer wg.Done()
+			err := eredes.gatherCpeUsages(acc, s, token, cpe, plans[cpe])
+			eredes.snapshot.recordCpe(cpe, err)
+			errs <- err
+		}(cpe)
+	}
+	wg.Wait()
+	close(errs)
+
+	var failed []error
+	for err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	return failed
+}
+
+// Count a failed attempt of a CPE, returns the consecutive failures
+func (eredes *EREDES) failedAttempt(cpe string) int {
+	eredes.attemptsLock.Lock()
+	defer eredes.attemptsLock.Unlock()
+
+	eredes.attempts[cpe]++
+	return eredes.attempts[cpe]
+}
+
+func (eredes *EREDES) resetAttempts(cpe string) {
+	eredes.attemptsLock.Lock()
+	defer eredes.attemptsLock.Unlock()
+
+	delete(eredes.attempts, cpe)
+}
+
+// Gathers the usages of a supply point
+func (eredes *EREDES) gatherCpeUsages(
+	acc telegraf.Accumulator,
+	s *session,
 	token string,
+	cpe string,
+	plan *cpePlan,
 ) error {
+	// Forget what a failed window of the previous cycle left behind
+	eredes.estimates.reset(cpe)
+	eredes.emitted.take(cpe)
+	eredes.totals.take(cpe)
+	eredes.registers.take(cpe)
+
+	// Readings are still gathered without the contract and meter details
+	var m metadata
+	if eredes.ContractMetadata && !plan.contract {
+		m.contract = s.cachedContract(cpe)
+	} else if eredes.ContractMetadata {
+		var err error
+		m.contract, err = s.contract(cpe, token)
+		if err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "contract", eredes.contractURL(), err))
+		}
+	}
+	if eredes.MeterMetadata && !plan.meter {
+		m.meter = s.cachedMeter(cpe)
+	} else if eredes.MeterMetadata {
+		var err error
+		m.meter, err = s.meter(cpe, token)
+		if err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "meter", eredes.meterURL(), err))
+		}
+	}
 
-	log.Printf("[eredes] starting")
+	if plan.daily {
+		if err := eredes.gatherDaily(acc, s, token, cpe); err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "gatherDaily", eredes.usageURL(), err))
+		}
+	}
 
-	var start string = ""
-	var end string = ""
-	historyInterval := eredes.HistoryInterval.Duration
-	var twentyFourHours time.Duration = 24 * time.Hour
-	startDate := time.Now()
+	if plan.maxPower {
+		if err := eredes.gatherMaxPower(acc, s, token, cpe); err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "gatherMaxPower", eredes.maxPowerURL(), err))
+		}
+	}
 
-	//Note: start date is exclusive, so 00:00:00 won't be included in the request.
+	if plan.registers {
+		if err := eredes.gatherRegisters(acc, s, token, cpe); err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "gatherRegisters", eredes.registerReadingsURL(), err))
+		}
+	}
 
-	if eredes.StartDate == "" {
-		log.Printf("[eredes] no start date defined")
+	if plan.outages {
+		if err := eredes.gatherOutages(acc, s, token, cpe); err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "gatherOutages", eredes.outagesURL(), err))
+		}
+	}
 
-		if historyInterval == 0 || historyInterval < twentyFourHours {
-			log.Printf("[eredes] no history interval defined or < 24h, using 24h")
-			startDate = startDate.Add(-twentyFourHours)
-			startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 23, 59, 59, 0, startDate.Location())
-		} else {
-			startDate = startDate.Add(-historyInterval).Add(-twentyFourHours)
-			startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 23, 59, 59, 0, startDate.Location())
+	if plan.contractHistory {
+		if err := eredes.gatherContractHistory(acc, s, token, cpe); err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "gatherContractHistory", eredes.contractHistoryURL(), err))
 		}
-		start = startDate.Format("2006-01-02 15:04:05")
+	}
+
+	if plan.plannedOutages {
+		if err := eredes.gatherPlannedOutages(acc, s, token, cpe); err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "gatherPlannedOutages", eredes.plannedOutagesURL(), err))
+		}
+	}
+
+	if plan.monthly {
+		if err := eredes.gatherMonthly(acc, s, token, cpe); err != nil {
+			acc.AddError(eredes.cpeError(s, cpe, "gatherMonthly", eredes.monthlyReadingsURL(), err))
+		}
+	}
+
+	windows := plan.windows
+	if len(windows) > 1 {
+		eredes.snapshot.setState(stateBackfilling)
 	} else {
-		start = eredes.StartDate
+		eredes.snapshot.setState(stateGathering)
 	}
 
-	endDate := time.Now().Add(-twentyFourHours)
-	endDate = time.Date(endDate.Year(), endDate.Month(), endDate.Day(), 23, 59, 59, 59, endDate.Location())
-	end = endDate.Format("2006-01-02 15:04:05")
+	if eredes.harvesting(cpe) {
+		eredes.startHarvest(cpe)
+	}
 
-	log.Printf("[eredes] start date: " + start + " end date: " + end)
+	// Windows of a CPE are requested in order, the watermark advances after
+	// each one. A failed window, or one holding the watermark back, leaves
+	// the later ones for the next cycles. Supply points are still gathered
+	// concurrently, up to max_concurrent_requests.
+	var windowErr error
+	for _, w := range windows {
+		if err := eredes.gatherWindow(acc, s, token, cpe, m, w.start, w.end); err != nil {
+			windowErr = &requestError{
+				account:  s.name,
+				cpe:      cpe,
+				name:     eredes.CpeAliases[cpe],
+				start:    w.start,
+				end:      w.end,
+				endpoint: eredes.usageURL(),
+				attempt:  eredes.failedAttempt(cpe),
+				err:      err,
+			}
+			break
+		}
+		eredes.resetAttempts(cpe)
+
+		watermark, heldBack := eredes.windowWatermark(cpe, w.end)
+		eredes.commitEmitted(cpe, watermark)
+		eredes.commitTotal(cpe)
+		eredes.commitRegisters(cpe)
+		if err := eredes.state.setWatermark(cpe, watermark, eredes.StateFile); err != nil {
+			log.Printf("[eredes] error saving state: %s", err)
+		}
+		if heldBack {
+			break
+		}
+	}
+
+	if eredes.harvesting(cpe) {
+		start, end := eredes.overrides[cpe].startDate, time.Time{}
+		if len(windows) > 0 {
+			end = windows[len(windows)-1].end
+		}
+		harvestErr := windowErr
+		if len(windows) < len(eredes.pendingWindows(cpe)) && harvestErr == nil {
+			harvestErr = fmt.Errorf("requests deferred by max_daily_requests")
+		}
+		eredes.reportHarvest(acc, cpe, start, end, harvestErr)
+	}
+
+	return windowErr
+}
+
+// Windows to request this cycle. The range is split so a long gap (ex:
+// agent was down for a week) is fetched in requests the API can handle,
+// paced over the next gather cycles.
+func (eredes *EREDES) pendingWindows(cpe string) []window {
+	startDate, endDate := eredes.requestWindow(cpe)
+	if eredes.harvesting(cpe) {
+		startDate = eredes.overrides[cpe].startDate
+		return splitWindow(startDate, endDate, eredes.CatchUpWindow.Duration)
+	}
+	if eredes.LatestOnly {
+		return []window{eredes.latestWindow()}
+	}
+
+	// A few monthly readings fit in any request
+	size := eredes.CatchUpWindow.Duration
+	if eredes.ReadingType == "monthly" {
+		size = 0
+	}
+
+	windows := splitWindow(startDate, endDate, size)
+	if len(windows) > eredes.CatchUpMaxRequests {
+		log.Printf("[eredes] %s catching up, %d windows pending, requesting %d this cycle", cpe, len(windows), eredes.CatchUpMaxRequests)
+		windows = windows[:eredes.CatchUpMaxRequests]
+	}
+	return windows
+}
 
-	var usagesRequestBody string = `{"cpe": "` + eredes.Cpe + `", "request_type":"3","start_date":"` + start + `","end_date":"` + end + `","wait":true,"formatted":false}`
+// Computes the range to request. If there's a watermark older than the
+// history interval, the range starts at the watermark so the gap is filled.
+//Note: start date is exclusive, so 00:00:00 won't be included in the request.
+func (eredes *EREDES) requestWindow(cpe string) (time.Time, time.Time) {
+	historyInterval := eredes.HistoryInterval.Duration
+	firstDate := eredes.startDate
+	if o, ok := eredes.overrides[cpe]; ok {
+		if o.HistoryInterval.Duration != 0 {
+			historyInterval = o.HistoryInterval.Duration
+		}
+		if !o.startDate.IsZero() {
+			firstDate = o.startDate
+		}
+	}
+
+	if historyInterval < 24*time.Hour {
+		log.Printf("[eredes] no history interval defined or < 24h, using 24h")
+		historyInterval = 24 * time.Hour
+	}
+
+	startDate := historyStart(time.Now().In(eredes.location), historyInterval)
+
+	if watermark, ok := eredes.state.watermark(cpe); ok {
+		if watermark.Before(startDate) {
+			log.Printf("[eredes] last gathered until %s, catching up", watermark.Format("2006-01-02 15:04:05"))
+			startDate = watermark.In(eredes.location)
+		}
+	} else if !firstDate.IsZero() {
+		log.Printf("[eredes] no watermark, using start date")
+		startDate = firstDate
+	}
+
+	// Monthly readings are requested from the start of the month, so the
+	// current month is updated every day
+	if eredes.ReadingType == "monthly" {
+		startDate = time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, startDate.Location()).Add(-time.Second)
+	}
+
+	return startDate, eredes.publishedUntil()
+}
+
+// Start of the history interval before now, the end of the day before its
+// first day. Whole days are counted on the calendar, so the days where the
+// clock changes (23h or 25h long) don't shift the range by an hour.
+func historyStart(now time.Time, historyInterval time.Duration) time.Time {
+	days := int(historyInterval / (24 * time.Hour))
+	start := now.Add(-(historyInterval % (24 * time.Hour))).AddDate(0, 0, -days-1)
+	return time.Date(start.Year(), start.Month(), start.Day(), 23, 59, 59, 0, now.Location())
+}
 
-	usageURL := eredes.UsageURL
+// End of the last day published, yesterday
+func (eredes *EREDES) publishedUntil() time.Time {
+	endDate := time.Now().In(eredes.location).AddDate(0, 0, -1)
+	return time.Date(endDate.Year(), endDate.Month(), endDate.Day(), 23, 59, 59, 0, eredes.location)
+}
+
+// Range of the latest day published, yesterday, or of the current month
+// for monthly readings
+func (eredes *EREDES) latestWindow() window {
+	endDate := eredes.publishedUntil()
+
+	startDate := endDate.AddDate(0, 0, -1)
+	startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 23, 59, 59, 0, startDate.Location())
+	if eredes.ReadingType == "monthly" {
+		startDate = time.Date(startDate.Year(), startDate.Month(), 1, 0, 0, 0, 0, startDate.Location()).Add(-time.Second)
+	}
+
+	return window{start: startDate, end: endDate}
+}
+
+// CpeOverride changes the requested range of a supply point, ex: one that
+// became smart-metered later than the others, or where its readings go
+type CpeOverride struct {
+	Cpe             string            `toml:"cpe"`
+	StartDate       string            `toml:"start_date"`
+	HistoryInterval internal.Duration `toml:"history_interval"`
 
-	if usageURL == "" {
-		usageURL = eredesUsage
+	// Measurement of the readings, instead of the parser's
+	Measurement string `toml:"measurement"`
+
+	// Request the whole history since start_date every cycle, without the
+	// catch up limit, and report its completeness. For a contract that's
+	// ending (ex: moving out), before access is revoked.
+	FinalHarvest bool `toml:"final_harvest"`
+
+	// Tariff cycle of the contract of this supply point
+	TariffCycle string `toml:"tariff_cycle"`
+
+	startDate time.Time
+}
+
+func (o *CpeOverride) init(location *time.Location) error {
+	if o.Cpe == "" {
+		return fmt.Errorf("cpe_override: cpe is required")
+	}
+
+	if o.FinalHarvest && o.StartDate == "" {
+		return fmt.Errorf("cpe_override %s: final_harvest requires start_date", o.Cpe)
 	}
 
-	// log.Printf("[eredes] request URL: " + usageURL)
-	// log.Printf("[eredes] request body: " + usagesRequestBody)
+	if !validTariffCycle(o.TariffCycle) {
+		return fmt.Errorf("cpe_override %s: invalid tariff_cycle %q, expected daily or weekly", o.Cpe, o.TariffCycle)
+	}
 
-	if !eredes.RunTestsOnly {
-		log.Printf("[eredes] requesting usages")
-		response, err := eredes.makeRequest(eredesUsage, usagesRequestBody, token)
+	if o.StartDate != "" {
+		var err error
+		o.startDate, err = time.ParseInLocation("2006-01-02 15:04:05", o.StartDate, location)
 		if err != nil {
-			return err
+			return fmt.Errorf("cpe_override %s: invalid start_date: %s", o.Cpe, err)
 		}
+	}
+	return nil
+}
+
+// Add a reading to the snapshot and the final harvest counts. The daily
+// totals and the completeness are of the consumption.
+func (eredes *EREDES) recordReading(r Reading) {
+	if r.Direction != "" && r.Direction != "consumption" {
+		return
+	}
+	eredes.snapshot.recordReading(r)
+	eredes.recordHarvest(r)
+}
+
+// Measurement of the readings of a CPE, if not the given one. With
+// split_measurements each kind of reading has its own.
+func (eredes *EREDES) measurement(cpe string, name string, direction string) string {
+	if o, ok := eredes.overrides[cpe]; ok && o.Measurement != "" {
+		return o.Measurement
+	}
+	if eredes.Measurement != "" {
+		return eredes.Measurement
+	}
+	if !eredes.SplitMeasurements {
+		return name
+	}
+
+	switch {
+	case name == "eredes_maxpower":
+		return name
+	case direction == "injection":
+		return "eredes_injection"
+	case eredes.isFlow(direction):
+		return "eredes_upac"
+	case eredes.ReadingType == "daily":
+		return "eredes_daily"
+	case eredes.ReadingType == "monthly":
+		return "eredes_monthly"
+	}
+	return "eredes_curve"
+}
 
-		// log.Printf("[eredes] response:")
-		// log.Printf(string(response))
+// Tags identifying a supply point, with its alias if configured
+func (eredes *EREDES) cpeTags(cpe string) map[string]string {
+	tags := map[string]string{"cpe": cpe}
+	if name, ok := eredes.CpeAliases[cpe]; ok {
+		tags["name"] = name
+	}
+	return tags
+}
+
+type window struct {
+	start time.Time
+	end   time.Time
+}
+
+// Split a range into consecutive windows of at most size
+func splitWindow(start time.Time, end time.Time, size time.Duration) []window {
+	var windows []window
+	for start.Before(end) {
+		windowEnd := addCalendar(start, size)
+		if size <= 0 || windowEnd.After(end) {
+			windowEnd = end
+		}
+		windows = append(windows, window{start: start, end: windowEnd})
+		start = windowEnd
+	}
+	return windows
+}
+
+// Adds a duration, counting whole days on the calendar so a window that
+// crosses a clock change still ends at the same time of day
+func addCalendar(t time.Time, d time.Duration) time.Time {
+	if d <= 0 || d%(24*time.Hour) != 0 {
+		return t.Add(d)
+	}
+	return t.AddDate(0, 0, int(d/(24*time.Hour)))
+}
+
+// Request and parse the usages of a single window
+func (eredes *EREDES) gatherWindow(
+	acc telegraf.Accumulator,
+	s *session,
+	token string,
+	cpe string,
+	m metadata,
+	startDate time.Time,
+	endDate time.Time,
+) error {
+	if err := eredes.gatherDirection(acc, s, token, cpe, m, "consumption", startDate, endDate); err != nil {
+		return err
+	}
 
-		metrics, err := eredes.parser.Parse(response)
+	// Energy injected into the grid (ex: solar panels) is a separate curve
+	if eredes.IncludeInjection {
+		if err := eredes.gatherDirection(acc, s, token, cpe, m, "injection", startDate, endDate); err != nil {
+			return fmt.Errorf("injection: %w", err)
+		}
+	}
+
+	// Self-consumption units have a curve per flow
+	if eredes.UPAC {
+		for _, flow := range upacFlows {
+			if err := eredes.gatherDirection(acc, s, token, cpe, m, flow, startDate, endDate); err != nil {
+				return fmt.Errorf("%s: %w", flow, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Request and parse the usages of a window in one direction, consumption
+// or injection, or UPAC flow
+func (eredes *EREDES) gatherDirection(
+	acc telegraf.Accumulator,
+	s *session,
+	token string,
+	cpe string,
+	m metadata,
+	direction string,
+	startDate time.Time,
+	endDate time.Time,
+) error {
+	start := startDate.Format("2006-01-02 15:04:05")
+	end := endDate.Format("2006-01-02 15:04:05")
+
+	log.Printf("[eredes] start date: " + start + " end date: " + end)
+
+	response, err := s.fetcher.FetchUsage(token, cpe, direction, startDate, endDate)
+	if err != nil {
+		return err
+	}
+
+	// log.Printf("[eredes] response:")
+	// log.Printf(string(response))
+
+	var metrics []telegraf.Metric
+	if len(eredes.TransformCommand) > 0 {
+		readings, err := eredes.transform(response)
+		if err != nil {
+			return err
+		}
+		if metrics, err = readingMetrics(readings); err != nil {
+			return err
+		}
+	} else {
+		eredes.parserLock.Lock()
+		metrics, err = eredes.parser.Parse(response)
+		eredes.parserLock.Unlock()
 		if err != nil {
 			return err
 		}
+	}
 
-		if len(metrics) > 0 {
-			log.Printf("[eredes] adding %d metrics", len(metrics))
-			for _, metric := range metrics {
-				acc.AddFields(metric.Name(), metric.Fields(), metric.Tags(), metric.Time())
+	metrics = eredes.dropOutOfWindow(metrics, cpe, startDate, endDate)
+	for _, metric := range metrics {
+		metric.SetTime(eredes.alignTimestamp(metric.Time()))
+	}
+	// In order, so the readings after an estimated one dropped aren't counted
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].Time().Before(metrics[j].Time()) })
+
+	eredes.filterFields(metrics)
+	eredes.postProcess(metrics)
+	eredes.convertUnits(metrics)
+
+	if len(metrics) > 0 {
+		log.Printf("[eredes] adding %d metrics", len(metrics))
+		costs := make(dailyCosts)
+		var readings []Reading
+		var series []readingSeries
+		emitted := eredes.emittedUntil(cpe, direction)
+		for _, metric := range metrics {
+			if !metric.Time().After(emitted) {
+				continue
+			}
+			quality := eredes.takeQuality(metric)
+			source := eredes.takeSource(metric)
+			phases := eredes.takePhases(metric)
+			if eredes.dropEstimated(cpe, quality, metric.Time()) {
+				continue
 			}
-		} else {
-			log.Printf("[eredes] no metrics to add")
-		}
 
+			tags := metric.Tags()
+			for k, v := range eredes.cpeTags(cpe) {
+				tags[k] = v
+			}
+			if eredes.isFlow(direction) {
+				tags["flow"] = direction
+			} else if eredes.IncludeInjection {
+				tags["direction"] = direction
+			}
+			if quality != "" {
+				tags["quality"] = quality
+			}
+			if source != "" {
+				tags["source"] = source
+			}
+			eredes.tagTariffPeriod(tags, cpe, metric.Time())
+			reading, err := newReading(cpe, metric, eredes.consumptionField(), eredes.readingResolution())
+			if errors.Is(err, errEmptyReading) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fields := metric.Fields()
+			reading.Direction = direction
+			reading.Quality = quality
+			reading.Source = source
+			for k, v := range phases {
+				fields[k] = v
+			}
+			eredes.recordReading(reading)
+			readings = append(readings, reading)
+			m.apply(tags, fields)
+			series = append(series, readingSeries{time: metric.Time(), name: metric.Name(), tags: copyTags(tags)})
+			eredes.addCost(costs, tags, fields, reading)
+			eredes.addTotal(fields, reading)
+			eredes.renameFields(fields)
+			eredes.convertTypes(fields)
+			if name, ok := eredes.applySchema(eredes.measurement(cpe, metric.Name(), direction), tags, fields); ok {
+				acc.AddFields(name, fields, tags, metric.Time())
+			}
+		}
+		eredes.addDailyCosts(acc, cpe, costs)
+		eredes.addOMIECosts(acc, cpe, readings)
+		eredes.addAggregates(acc, cpe, readings)
+		after := startDate
+		if emitted.After(after) {
+			after = emitted
+		}
+		eredes.fillMissing(acc, cpe, direction, series, after, endDate)
+		eredes.setEmitted(cpe, direction, readings)
+	} else {
+		log.Printf("[eredes] no metrics to add")
 	}
 
 	return nil
@@ -223,35 +1827,123 @@ func (eredes *EREDES) gatherUsages(
 // Parameters:
 // Returns:
 //	   token: The authentication token
+//	   refreshToken: The token to get a new one without signing in again
 //     error: Any error that may have occurred
-func (eredes *EREDES) signIn() (string, error) {
-	if eredes.RunTestsOnly {
-		return "TOKEN1234567890", nil
-	}
+func (s *session) signIn() (string, string, error) {
+	signInURL := s.eredes.signInURL()
 
-	signInURL := eredes.SignInURL
-
-	if signInURL == "" {
-		signInURL = eredesSignIn
+	username, password, err := s.credentials()
+	if err != nil {
+		return "", "", err
 	}
 
-	log.Printf("[eredes] login")
-	signInRequestBody := `{"password": "` + eredes.Password + `", "username": "` + eredes.Username + `"}`
+	log.Printf("[eredes] login %s", s.name)
+	signInRequestBody := `{"password": "` + password + `", "username": "` + username + `"}`
 	// log.Printf("[signIn] request URL: " + signInURL)
 	// log.Printf("[signIn] request body: " + signInRequestBody)
 
-	response, err := eredes.makeRequest(signInURL, signInRequestBody, "")
+	response, err := s.makeRequest(signInURL, signInRequestBody, "")
 	if err != nil {
 		log.Printf("[eredes] error login")
-		return "", err
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && isPasswordExpired(statusErr.body) {
+			return "", "", errPasswordExpired
+		}
+		return "", "", err
 	}
 
 	// log.Printf("[eredes] response:")
 	// log.Printf(string(response))
+	token := gjson.Get(string(response), s.eredes.TokenJSONPath)
+	if token.String() == "" && isPasswordExpired(response) {
+		return "", "", errPasswordExpired
+	}
 	log.Printf("[eredes] login successful")
-	token := gjson.Get(string(response), "Body.Result.token")
+	refreshToken := gjson.Get(string(response), "Body.Result.refreshToken")
 
-	return token.String(), nil
+	return token.String(), refreshToken.String(), nil
+}
+
+// Get a new token with the refresh token from a previous sign in
+// Returns:
+//	   token: The authentication token
+//	   refreshToken: The refresh token to use next time
+//     error: Any error that may have occurred
+func (s *session) refreshToken(refreshToken string) (string, string, error) {
+	refreshURL := s.eredes.refreshURL()
+
+	log.Printf("[eredes] refreshing token")
+	refreshRequestBody := `{"refreshToken": "` + refreshToken + `"}`
+
+	response, err := s.makeRequest(refreshURL, refreshRequestBody, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	token := gjson.Get(string(response), s.eredes.TokenJSONPath).String()
+	if token == "" {
+		return "", "", fmt.Errorf("no token in %q of refresh response", s.eredes.TokenJSONPath)
+	}
+
+	// Keep the current refresh token if the response doesn't rotate it
+	if newRefreshToken := gjson.Get(string(response), "Body.Result.refreshToken").String(); newRefreshToken != "" {
+		refreshToken = newRefreshToken
+	}
+
+	return token, refreshToken, nil
+}
+
+func (eredes *EREDES) signInURL() string {
+	if eredes.SignInURL == "" {
+		return eredesSignIn
+	}
+	return eredes.SignInURL
+}
+
+func (eredes *EREDES) refreshURL() string {
+	if eredes.RefreshURL == "" {
+		return eredesRefresh
+	}
+	return eredes.RefreshURL
+}
+
+func (eredes *EREDES) cpesURL() string {
+	if eredes.CpesURL == "" {
+		return eredesCpes
+	}
+	return eredes.CpesURL
+}
+
+func (eredes *EREDES) usageURL() string {
+	if eredes.UsageURL == "" {
+		return eredesUsage
+	}
+	return eredes.UsageURL
+}
+
+// List the supply points of the account
+// Returns:
+//	   cpes: The CPEs selected by discover_cpes_path
+//     error: Any error that may have occurred
+func (s *session) discoverCpes(token string) ([]string, error) {
+	log.Printf("[eredes] discovering cpes of %s", s.name)
+	response, err := s.makeRequest(s.eredes.cpesURL(), "{}", token)
+	if err != nil {
+		return nil, err
+	}
+
+	var cpes []string
+	for _, cpe := range gjson.Get(string(response), s.eredes.DiscoverCpesPath).Array() {
+		if cpe.String() != "" {
+			cpes = append(cpes, cpe.String())
+		}
+	}
+	if len(cpes) == 0 {
+		return nil, fmt.Errorf("no cpes found in %q", s.eredes.DiscoverCpesPath)
+	}
+
+	log.Printf("[eredes] discovered cpes: %s", strings.Join(cpes, ", "))
+	return cpes, nil
 }
 
 // Make request to a particular URL
@@ -261,7 +1953,7 @@ func (eredes *EREDES) signIn() (string, error) {
 // Returns:
 //	   response: The parsed response
 //     error: Any error that may have occurred
-func (eredes *EREDES) makeRequest(
+func (s *session) makeRequest(
 	url string,
 	requestBody string,
 	token string,
@@ -277,7 +1969,7 @@ func (eredes *EREDES) makeRequest(
 		return nil, err
 	}
 
-	for k, v := range eredes.Headers {
+	for k, v := range s.eredes.Headers {
 		if strings.ToLower(k) == "host" {
 			request.Host = v
 		} else {
@@ -291,37 +1983,144 @@ func (eredes *EREDES) makeRequest(
 	}
 
 	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.1.2 Safari/605.1.15")
+	request.Header.Set("User-Agent", s.eredes.userAgent())
+	// Set explicitly, so the response is decompressed here and its sizes
+	// logged, instead of transparently by the transport
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	s.eredes.requests <- struct{}{}
+	defer func() { <-s.eredes.requests }()
 
-	resp, err := eredes.client.Do(request)
+	s.eredes.state.countRequest()
+	resp, err := s.client.Do(request)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	responseHasSuccessCode := false
-	for _, statusCode := range eredes.SuccessStatusCodes {
+	for _, statusCode := range s.eredes.SuccessStatusCodes {
 		if resp.StatusCode == statusCode {
 			responseHasSuccessCode = true
 			break
 		}
 	}
 
+	b, err := readBody(resp, url, s.eredes.MaxBodySize.Size)
+	if err != nil {
+		return nil, err
+	}
+
 	if !responseHasSuccessCode {
-		return nil, fmt.Errorf("received status code %d (%s), expected any value out of %v",
-			resp.StatusCode,
-			http.StatusText(resp.StatusCode),
-			eredes.SuccessStatusCodes)
+		return nil, &statusError{
+			statusCode:         resp.StatusCode,
+			successStatusCodes: s.eredes.SuccessStatusCodes,
+			body:               b,
+		}
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if err := checkContentType(resp.Header.Get("Content-Type"), b); err != nil {
 		return nil, err
 	}
 
 	return b, nil
 }
 
+// User-Agent of the next request, user_agents in turn or user_agent
+func (eredes *EREDES) userAgent() string {
+	if len(eredes.UserAgents) == 0 {
+		return eredes.UserAgent
+	}
+	i := atomic.AddUint32(&eredes.userAgentIndex, 1) - 1
+	return eredes.UserAgents[i%uint32(len(eredes.UserAgents))]
+}
+
+// Parse the configured certificate fingerprints, accepting both plain hex
+// and the colon separated form printed by openssl
+func parsePinnedCerts(fingerprints []string) ([][]byte, error) {
+	pins := make([][]byte, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		pin, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned_cert_sha256 %q", fingerprint)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// Returns a VerifyPeerCertificate callback that only accepts the connection
+// if the server certificate, or one of its chain (ex: the intermediate CA,
+// which survives the leaf renewals), matches one of the pinned fingerprints.
+// It runs after the standard chain verification, so it doesn't replace it.
+func verifyPinnedCert(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no server certificate to check against pinned_cert_sha256")
+		}
+
+		certs := append([][]byte{}, rawCerts...)
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				certs = append(certs, cert.Raw)
+			}
+		}
+		for _, cert := range certs {
+			sum := sha256.Sum256(cert)
+			for _, pin := range pins {
+				if bytes.Equal(sum[:], pin) {
+					return nil
+				}
+			}
+		}
+
+		return fmt.Errorf("server certificate fingerprint %X doesn't match any pinned_cert_sha256", sha256.Sum256(rawCerts[0]))
+	}
+}
+
+// Readings can be stamped at the end of their interval, so the first one
+// after the end date still belongs to the window
+const windowTolerance = 15 * time.Minute
+
+// Drop the readings outside the requested window (ex: a stray point
+// timestamped tomorrow), so they don't pollute the dashboards
+func (eredes *EREDES) dropOutOfWindow(metrics []telegraf.Metric, cpe string, startDate time.Time, endDate time.Time) []telegraf.Metric {
+	kept := metrics[:0]
+	dropped := 0
+	for _, metric := range metrics {
+		t := metric.Time()
+		if t.Before(startDate.Add(-windowTolerance)) || t.After(endDate.Add(windowTolerance)) {
+			dropped++
+			continue
+		}
+		kept = append(kept, metric)
+	}
+
+	if dropped > 0 {
+		log.Printf("[eredes] %s dropped %d readings outside the requested window", cpe, dropped)
+		eredes.snapshot.recordDropped(dropped)
+	}
+	return kept
+}
+
+// Round a quarter-hour reading timestamp to the nearest quarter-hour with
+// align_timestamps, for responses with stray seconds
+func (eredes *EREDES) alignTimestamp(t time.Time) time.Time {
+	if !eredes.AlignTimestamps || eredes.ReadingType != "quarter_hourly" {
+		return t
+	}
+	return t.Round(15 * time.Minute)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func makeRequestBodyReader(body string) (io.ReadCloser, error) {
 	var reader io.Reader = strings.NewReader(body)
 	return ioutil.NopCloser(reader), nil
@@ -330,7 +2129,35 @@ func makeRequestBodyReader(body string) (io.ReadCloser, error) {
 func init() {
 	inputs.Add("eredes", func() telegraf.Input {
 		return &EREDES{
-			Timeout: internal.Duration{Duration: time.Second * 120},
+			Timeout:              internal.Duration{Duration: time.Second * 120},
+			MinLoginInterval:     internal.Duration{Duration: 10 * time.Minute},
+			MinEffectiveInterval: internal.Duration{Duration: time.Hour},
+			DiscoverCpesPath:     "Body.Result.#.cpe",
+			TokenJSONPath:        "Body.Result.token",
+			UserAgent:            defaultUserAgent,
+			MaxBodySize:          internal.Size{Size: 64 * 1024 * 1024},
+			IdleConnTimeout:      internal.Duration{Duration: 90 * time.Second},
+			VaultUsernameKey:     "username",
+			VaultPasswordKey:     "password",
+			CatchUpWindow:        internal.Duration{Duration: 7 * 24 * time.Hour},
+			CatchUpMaxRequests:   2,
+			TransformTimeout:     internal.Duration{Duration: 10 * time.Second},
+			DailyTotalsPath:      "Body.Result.utilitiesDevices.0.dailyConsumptions",
+			DailyTotalsDateKey:   "date",
+			DailyTotalsValueKey:  "consumption",
+			MonthlyReadingsPath:  "Body.Result.readings",
+			MaxPowerPath:         "Body.Result.maxPowers",
+			RegisterReadingsPath: "Body.Result.registers",
+			OutagesPath:          "Body.Result.interruptions",
+			PlannedOutagesPath:   "Body.Result.plannedInterruptions",
+			ContractHistoryPath:  "Body.Result.contractChanges",
+			InjectionRequestType: "4",
+			QualityKey:           "loadCurveQuality",
+			FormattedPath:        "Body.Result.formattedData",
+			AsyncIDPath:          "Body.Result.requestId",
+			AsyncStatusPath:      "Body.Result.status",
+			AsyncPollInterval:    internal.Duration{Duration: 5 * time.Second},
+			AsyncTimeout:         internal.Duration{Duration: 5 * time.Minute},
 		}
 	})
 }
@@ -0,0 +1,1575 @@
+package eredes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      string
+		interval time.Duration
+		start    string
+	}{
+		{"one day", "2024-01-15 10:00", 24 * time.Hour, "2024-01-13 23:59:59 +0000"},
+		{"across summer time", "2024-04-01 10:00", 72 * time.Hour, "2024-03-28 23:59:59 +0000"},
+		{"from summer time", "2024-03-31 10:00", 24 * time.Hour, "2024-03-29 23:59:59 +0000"},
+		{"across winter time", "2024-10-28 10:00", 72 * time.Hour, "2024-10-24 23:59:59 +0100"},
+		{"partial day across winter time", "2024-10-28 10:00", 36 * time.Hour, "2024-10-25 23:59:59 +0100"},
+		{"a week", "2024-04-03 00:30", 168 * time.Hour, "2024-03-26 23:59:59 +0000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now, err := time.ParseInLocation("2006-01-02 15:04", tt.now, lisbon)
+			require.NoError(t, err)
+			assert.Equal(t, tt.start, historyStart(now, tt.interval).Format("2006-01-02 15:04:05 -0700"))
+		})
+	}
+}
+
+func TestHoliday(t *testing.T) {
+	tests := []struct {
+		name    string
+		date    string
+		holiday bool
+	}{
+		{"new year", "2024-01-01", true},
+		{"good friday", "2024-03-29", true},
+		{"easter", "2024-03-31", true},
+		{"easter monday", "2024-04-01", false},
+		{"freedom day", "2024-04-25", true},
+		{"corpus christi", "2024-05-30", true},
+		{"corpus christi suspended", "2014-06-19", false},
+		{"republic day", "2024-10-05", true},
+		{"republic day suspended", "2014-10-05", false},
+		{"christmas", "2024-12-25", true},
+		{"working day", "2024-03-28", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day, err := time.ParseInLocation("2006-01-02", tt.date, lisbon)
+			require.NoError(t, err)
+			assert.Equal(t, tt.holiday, holiday(day.Add(12*time.Hour)))
+		})
+	}
+}
+
+func TestTagTariffPeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		cycle       string
+		readingType string
+		time        string
+		period      string
+	}{
+		{"daily winter night", "daily", "quarter_hourly", "2024-01-15 03:00", "vazio"},
+		{"daily winter ponta", "daily", "quarter_hourly", "2024-01-15 09:30", "ponta"},
+		{"daily summer ponta", "daily", "quarter_hourly", "2024-07-15 11:00", "ponta"},
+		{"daily summer cheias", "daily", "quarter_hourly", "2024-07-15 09:30", "cheias"},
+		{"weekly weekday ponta", "weekly", "quarter_hourly", "2024-01-15 10:00", "ponta"},
+		{"weekly saturday", "weekly", "quarter_hourly", "2024-01-13 10:00", "cheias"},
+		{"weekly sunday", "weekly", "quarter_hourly", "2024-01-14 10:00", "vazio"},
+		{"weekly holiday", "weekly", "quarter_hourly", "2024-12-25 10:00", "vazio"},
+		{"summer time starts", "daily", "quarter_hourly", "2024-03-31 10:30", "ponta"},
+		{"no cycle", "", "quarter_hourly", "2024-01-15 09:30", ""},
+		{"daily readings", "daily", "daily", "2024-01-15 09:30", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eredes := &EREDES{
+				TariffCycle:     tt.cycle,
+				ReadingType:     tt.readingType,
+				tariffSchedules: erseTariffSchedules,
+			}
+			at, err := time.ParseInLocation("2006-01-02 15:04", tt.time, lisbon)
+			require.NoError(t, err)
+
+			tags := map[string]string{}
+			eredes.tagTariffPeriod(tags, "PT0002", at)
+			assert.Equal(t, tt.period, tags["tariff_period"])
+		})
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		maxSize  int64
+		expected string
+		err      bool
+	}{
+		{"no limit", []byte("0123456789"), 0, "0123456789", false},
+		{"under the limit", []byte("0123456789"), 20, "0123456789", false},
+		{"at the limit", []byte("0123456789"), 10, "0123456789", false},
+		{"over the limit", []byte("0123456789"), 9, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{},
+				Body:   ioutil.NopCloser(bytes.NewReader(tt.body)),
+			}
+
+			b, err := readBody(resp, "https://example.com", tt.maxSize)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(b))
+		})
+	}
+}
+
+func TestReadBodyGzip(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write([]byte(s))
+		gz.Close()
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		body     []byte
+		maxSize  int64
+		expected string
+		err      bool
+	}{
+		{"decompressed", gzipped("0123456789"), 10, "0123456789", false},
+		{"over the decompressed limit", gzipped(strings.Repeat("0", 1000)), 100, "", true},
+		{"not gzipped", []byte("0123456789"), 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{},
+				Body:   ioutil.NopCloser(bytes.NewReader(tt.body)),
+			}
+			resp.Header.Set("Content-Encoding", "gzip")
+
+			b, err := readBody(resp, "https://example.com", tt.maxSize)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(b))
+		})
+	}
+}
+
+func TestBodySnippet(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"plain", `{"error":"maintenance"}`, `{"error":"maintenance"}`},
+		{"token", `{"Body":{"Result":{"token":"abc.def"}}}`, `{"Body":{"Result":{"token":"[redacted]"}}}`},
+		{"key containing a secret word", `{"accessToken" : "abc", "user":"me"}`, `{"accessToken" : "[redacted]", "user":"me"}`},
+		{"escaped quote", `{"password":"a\"b"}`, `{"password":"[redacted]"}`},
+		{"bearer", `Authorization: Bearer abc.def-ghi=`, `Authorization: Bearer [redacted]`},
+		{"form", `username=me&password=p%40ss&access_token=abc.def`, `username=me&password=[redacted]&access_token=[redacted]`},
+		{"html link", `<a href="/login?token=abc&next=/">retry</a>`, `<a href="/login?token=[redacted]&next=/">retry</a>`},
+		{"html input", `<input type="hidden" name="csrf_token" value="abc">`, `<input type="hidden" name="csrf_token" value="[redacted]">`},
+		{"truncated on a character", strings.Repeat("a", snippetSize-1) + "ção", strings.Repeat("a", snippetSize-1) + "..."},
+		{"whitespace", "<html>\n  <body>down</body>\n</html>", `<html> <body>down</body> </html>`},
+		{"truncated", strings.Repeat("a", snippetSize+10), strings.Repeat("a", snippetSize) + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, bodySnippet([]byte(tt.body)))
+		})
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		err         bool
+	}{
+		{"no content type", "", "<html></html>", false},
+		{"json", "application/json", `{}`, false},
+		{"json with charset", "application/json; charset=utf-8", `{}`, false},
+		{"json suffix", "application/problem+json", `{}`, false},
+		{"json object as html", "text/html", ` {"a":1}`, false},
+		{"json array as text", "text/plain", `[1]`, false},
+		{"html", "text/html", "<html>maintenance</html>", true},
+		{"empty body", "text/html", "", true},
+		{"invalid content type", "json;;", "<html></html>", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkContentType(tt.contentType, []byte(tt.body))
+			if !tt.err {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "non-JSON response")
+		})
+	}
+}
+
+func TestPostProcess(t *testing.T) {
+	tests := []struct {
+		name       string
+		processors []*PostProcessor
+		values     []interface{}
+		expected   []interface{}
+	}{
+		{
+			name:       "median",
+			processors: []*PostProcessor{{Type: "median", Window: 3}},
+			values:     []interface{}{1.0, 9.0, 1.0, 2.0},
+			expected:   []interface{}{1.0, 1.0, 2.0, 2.0},
+		},
+		{
+			name:       "median spike",
+			processors: []*PostProcessor{{Type: "median", Window: 3}},
+			values:     []interface{}{1.0, 1.2, 9.0, 1.1, 1.0},
+			expected:   []interface{}{1.0, 1.2, 1.2, 1.1, 1.0},
+		},
+		{
+			name:       "median wider window",
+			processors: []*PostProcessor{{Type: "median", Window: 5}},
+			values:     []interface{}{9.0, 1.0, 2.0, 3.0, 9.0, 4.0},
+			expected:   []interface{}{9.0, 1.0, 3.0, 3.0, 9.0, 4.0},
+		},
+		{
+			name:       "clamp",
+			processors: []*PostProcessor{{Type: "clamp", Min: float(0), Max: float(2)}},
+			values:     []interface{}{-1.0, 1.0, 3.0},
+			expected:   []interface{}{0.0, 1.0, 2.0},
+		},
+		{
+			name:       "clamp max only",
+			processors: []*PostProcessor{{Type: "clamp", Max: float(2)}},
+			values:     []interface{}{-1.0, 1.0, 3.0},
+			expected:   []interface{}{-1.0, 1.0, 2.0},
+		},
+		{
+			name:       "clamp min only",
+			processors: []*PostProcessor{{Type: "clamp", Min: float(0)}},
+			values:     []interface{}{-1.0, 1.0, 3.0},
+			expected:   []interface{}{0.0, 1.0, 3.0},
+		},
+		{
+			name:       "scale",
+			processors: []*PostProcessor{{Type: "scale", Factor: 0.001}},
+			values:     []interface{}{125.0, 250.0},
+			expected:   []interface{}{0.125, 0.25},
+		},
+		{
+			name:       "string values",
+			processors: []*PostProcessor{{Type: "scale", Factor: 2}},
+			values:     []interface{}{"0.125", "0.25"},
+			expected:   []interface{}{"0.25", "0.5"},
+		},
+		{
+			name:       "integer values",
+			processors: []*PostProcessor{{Type: "scale", Factor: 0.001}},
+			values:     []interface{}{int64(1499), int64(1500)},
+			expected:   []interface{}{int64(1), int64(2)},
+		},
+		{
+			name: "chain",
+			processors: []*PostProcessor{
+				{Type: "scale", Factor: 10},
+				{Type: "clamp", Max: float(5)},
+			},
+			values:   []interface{}{0.1, 0.3, 0.9},
+			expected: []interface{}{1.0, 3.0, 5.0},
+		},
+		{
+			name:       "other field",
+			processors: []*PostProcessor{{Type: "scale", Factor: 2, Fields: []string{"other"}}},
+			values:     []interface{}{1.0, 2.0},
+			expected:   []interface{}{1.0, 2.0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, p := range tt.processors {
+				require.NoError(t, p.init())
+			}
+			eredes := &EREDES{PostProcessors: tt.processors}
+
+			start := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+			var metrics []telegraf.Metric
+			// Added in reverse, they're sorted by time first
+			for i := len(tt.values) - 1; i >= 0; i-- {
+				m, err := metric.New("eredes", nil, map[string]interface{}{"kwh": tt.values[i]}, start.Add(time.Duration(i)*15*time.Minute))
+				require.NoError(t, err)
+				metrics = append(metrics, m)
+			}
+
+			eredes.postProcess(metrics)
+
+			require.Len(t, metrics, len(tt.expected))
+			for i, m := range metrics {
+				value, _ := m.GetField("kwh")
+				if expected, ok := tt.expected[i].(float64); ok {
+					assert.InDelta(t, expected, value, 1e-9)
+				} else {
+					assert.Equal(t, tt.expected[i], value)
+				}
+			}
+		})
+	}
+}
+
+// Certificate signed by parent, or self-signed without one
+func testCert(t *testing.T, name string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParsePinnedCerts(t *testing.T) {
+	sum := sha256.Sum256([]byte("certificate"))
+	colons := strings.ToUpper(hex.EncodeToString(sum[:1]))
+	for _, b := range sum[1:] {
+		colons += ":" + strings.ToUpper(hex.EncodeToString([]byte{b}))
+	}
+
+	tests := []struct {
+		name        string
+		fingerprint string
+		err         bool
+	}{
+		{"hex", hex.EncodeToString(sum[:]), false},
+		{"openssl colons", colons, false},
+		{"spaces", " " + colons + " ", false},
+		{"not hex", "not a fingerprint", true},
+		{"sha1", strings.Repeat("AB", 20), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parsePinnedCerts([]string{tt.fingerprint})
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, pins, 1)
+			assert.Equal(t, sum[:], pins[0])
+		})
+	}
+}
+
+func TestVerifyPinnedCert(t *testing.T) {
+	root, rootKey := testCert(t, "root", true, nil, nil)
+	intermediate, intermediateKey := testCert(t, "intermediate", true, root, rootKey)
+	leaf, _ := testCert(t, "online.e-redes.pt", false, intermediate, intermediateKey)
+	other, _ := testCert(t, "other", false, nil, nil)
+
+	// The server sends the leaf and the intermediate, the root comes from
+	// the verified chain
+	rawCerts := [][]byte{leaf.Raw, intermediate.Raw}
+	chains := [][]*x509.Certificate{{leaf, intermediate, root}}
+
+	tests := []struct {
+		name   string
+		pins   []string
+		chains [][]*x509.Certificate
+		err    bool
+	}{
+		{"leaf", []string{fingerprint(leaf)}, chains, false},
+		{"intermediate", []string{fingerprint(intermediate)}, chains, false},
+		{"intermediate without verified chains", []string{fingerprint(intermediate)}, nil, false},
+		{"root", []string{fingerprint(root)}, chains, false},
+		{"one of several", []string{fingerprint(other), fingerprint(leaf)}, chains, false},
+		{"mismatch", []string{fingerprint(other)}, chains, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parsePinnedCerts(tt.pins)
+			require.NoError(t, err)
+
+			err = verifyPinnedCert(pins)(rawCerts, tt.chains)
+			if tt.err {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), strings.ToUpper(fingerprint(leaf)))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	err := verifyPinnedCert(nil)(nil, nil)
+	require.Error(t, err)
+}
+
+func TestOMIECosts(t *testing.T) {
+	// Price file with a period price per period of the day
+	priceFile := func(date string, periods int) string {
+		file := "MARGINALPDBCPT;\n"
+		for period := 1; period <= periods; period++ {
+			file += fmt.Sprintf("%s;%s;%s;%d;%d,00;%d,00;\n", date[:4], date[4:6], date[6:], period, period, period)
+		}
+		return file + "*\n"
+	}
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date := r.URL.Query().Get("date")
+		lock.Lock()
+		requests[date]++
+		lock.Unlock()
+
+		switch date {
+		case "20240115":
+			fmt.Fprint(w, priceFile(date, 24))
+		case "20251002":
+			fmt.Fprint(w, priceFile(date, 96))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	eredes := &EREDES{
+		ReadingType: "quarter_hourly",
+		OMIE:        &OMIE{URL: ts.URL + "?date={date}"},
+	}
+	eredes.OMIE.init(http.DefaultTransport, time.Second)
+
+	// Quarter-hour readings of 0.25 kWh from midnight in Spanish time
+	readings := func(date string, n int) []Reading {
+		day, err := time.ParseInLocation("20060102", date, madrid)
+		require.NoError(t, err)
+		var readings []Reading
+		for i := 0; i < n; i++ {
+			readings = append(readings, Reading{Time: day.Add(time.Duration(i) * 15 * time.Minute), Kwh: 0.25})
+		}
+		return readings
+	}
+
+	tests := []struct {
+		name     string
+		readings []Reading
+		points   int
+		price    float64
+		kwh      float64
+		errors   int
+	}{
+		{"hourly prices", readings("20240115", 8), 2, 1, 1, 0},
+		{"quarter-hour prices", readings("20251002", 8), 8, 1, 0.25, 0},
+		{"not published", readings("20240116", 96), 0, 0, 0, 1},
+		{"not published, next window", readings("20240116", 96), 0, 0, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var acc testutil.Accumulator
+			eredes.addOMIECosts(&acc, "PT0002", tt.readings)
+
+			require.Len(t, acc.Errors, tt.errors)
+			require.Len(t, acc.Metrics, tt.points)
+			if tt.points == 0 {
+				return
+			}
+			first := acc.Metrics[0]
+			assert.Equal(t, "eredes_omie", first.Measurement)
+			assert.Equal(t, tt.readings[0].Time.Unix(), first.Time.Unix())
+			assert.InDelta(t, tt.price, first.Fields["price_eur_mwh"], 1e-9)
+			assert.InDelta(t, tt.kwh, first.Fields["kwh"], 1e-9)
+			assert.InDelta(t, tt.kwh*tt.price/1000, first.Fields["cost_eur"], 1e-9)
+		})
+	}
+
+	// A day not published yet is requested once, not per reading or window
+	assert.Equal(t, 1, requests["20240116"])
+	assert.Equal(t, 1, requests["20240115"])
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+func TestPostProcessorInit(t *testing.T) {
+	tests := []struct {
+		name      string
+		processor PostProcessor
+		err       bool
+	}{
+		{"median default window", PostProcessor{Type: "median"}, false},
+		{"median negative window", PostProcessor{Type: "median", Window: -1}, true},
+		{"clamp without bounds", PostProcessor{Type: "clamp"}, true},
+		{"clamp max below min", PostProcessor{Type: "clamp", Min: float(2), Max: float(1)}, true},
+		{"clamp max zero", PostProcessor{Type: "clamp", Max: float(0)}, false},
+		{"scale without factor", PostProcessor{Type: "scale"}, true},
+		{"unknown", PostProcessor{Type: "mean"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.processor.init()
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestServeHealthTokens(t *testing.T) {
+	eredes := &EREDES{
+		HealthTokens: []*HealthToken{
+			{Token: "admin-secret"},
+			{Token: "tenant-secret", Cpes: []string{"PT0002A"}},
+		},
+	}
+	eredes.snapshot.recordGather(fmt.Errorf("PT0002B: portal down"))
+	eredes.snapshot.recordCpe("PT0002A", nil)
+	eredes.snapshot.recordCpe("PT0002B", fmt.Errorf("portal down"))
+	yesterday := time.Now().Add(-24 * time.Hour)
+	eredes.snapshot.recordReading(Reading{Cpe: "PT0002A", Time: yesterday, Kwh: 0.125})
+	eredes.snapshot.recordReading(Reading{Cpe: "PT0002B", Time: yesterday, Kwh: 0.25})
+
+	tests := []struct {
+		name          string
+		authorization string
+		query         string
+		status        int
+		cpes          []string
+	}{
+		{"no token", "", "", http.StatusUnauthorized, nil},
+		{"wrong token", "Bearer wrong", "", http.StatusUnauthorized, nil},
+		{"token prefix", "Bearer admin", "", http.StatusUnauthorized, nil},
+		{"token without bearer", "admin-secret", "", http.StatusUnauthorized, nil},
+		{"basic auth", "Basic admin-secret", "", http.StatusUnauthorized, nil},
+		{"admin", "Bearer admin-secret", "", http.StatusServiceUnavailable, []string{"PT0002A", "PT0002B"}},
+		{"admin lowercase bearer", "bearer admin-secret", "", http.StatusServiceUnavailable, []string{"PT0002A", "PT0002B"}},
+		{"admin one cpe", "Bearer admin-secret", "?cpe=PT0002B", http.StatusServiceUnavailable, []string{"PT0002B"}},
+		{"tenant", "Bearer tenant-secret", "", http.StatusOK, []string{"PT0002A"}},
+		{"tenant own cpe", "Bearer tenant-secret", "?cpe=PT0002A", http.StatusOK, []string{"PT0002A"}},
+		{"tenant other cpe", "Bearer tenant-secret", "?cpe=PT0002B", http.StatusForbidden, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/health"+tt.query, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			eredes.serveHealth(w, r)
+
+			require.Equal(t, tt.status, w.Code)
+			if tt.cpes == nil {
+				assert.Empty(t, w.Body.String())
+				return
+			}
+
+			var response struct {
+				LastError   string               `json:"last_error"`
+				DailyTotals []DailyTotal         `json:"daily_totals"`
+				Tokens      map[string]TokenInfo `json:"tokens"`
+				Cpes        map[string]CpeStatus `json:"cpes"`
+			}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+			var cpes, totals []string
+			for cpe := range response.Cpes {
+				cpes = append(cpes, cpe)
+			}
+			for _, total := range response.DailyTotals {
+				totals = append(totals, total.Cpe)
+			}
+			sort.Strings(cpes)
+			sort.Strings(totals)
+			assert.Equal(t, tt.cpes, cpes)
+			assert.Equal(t, tt.cpes, totals)
+
+			// The errors of the other supply points aren't shown
+			if !contains(tt.cpes, "PT0002B") {
+				assert.Empty(t, response.LastError)
+			}
+		})
+	}
+}
+
+func TestDecryptCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{0x42}, 32)
+	otherKey := bytes.Repeat([]byte{0x24}, 32)
+
+	// Same format as the README snippet: base64 of the nonce and ciphertext
+	encrypt := func(key []byte, plaintext string) string {
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+		gcm, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+		nonce := make([]byte, gcm.NonceSize())
+		_, err = rand.Read(nonce)
+		require.NoError(t, err)
+		return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil))
+	}
+	credentials := encrypt(key, `{"username":"me@example.com","password":"secret"}`)
+	raw, err := base64.StdEncoding.DecodeString(credentials)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		file string
+		key  string
+		err  string
+	}{
+		{"hex key", credentials, hex.EncodeToString(key), ""},
+		{"base64 key", credentials, base64.StdEncoding.EncodeToString(key) + "\n", ""},
+		{"wrong key", credentials, hex.EncodeToString(otherKey), "wrong key"},
+		{"truncated file", base64.StdEncoding.EncodeToString(raw[:8]), hex.EncodeToString(key), "too short"},
+		{"truncated ciphertext", base64.StdEncoding.EncodeToString(raw[:len(raw)-4]), hex.EncodeToString(key), "wrong key"},
+		{"not base64", "not base64!", hex.EncodeToString(key), "base64"},
+		{"not json", encrypt(key, "me:secret"), hex.EncodeToString(key), "valid JSON"},
+		{"16 byte key", credentials, hex.EncodeToString(key[:16]), "32 byte key"},
+		{"16 byte base64 key", credentials, base64.StdEncoding.EncodeToString(key[:16]), "32 byte key"},
+		{"key not encoded", credentials, "not a key", "32 byte key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "eredes.enc")
+			keyPath := filepath.Join(dir, "eredes.key")
+			require.NoError(t, ioutil.WriteFile(path, []byte(tt.file), 0600))
+			require.NoError(t, ioutil.WriteFile(keyPath, []byte(tt.key), 0600))
+
+			decrypted, err := decryptCredentials(path, keyPath)
+			if tt.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, &encryptedCredentials{Username: "me@example.com", Password: "secret"}, decrypted)
+		})
+	}
+
+	_, err = decryptCredentials(filepath.Join(dir, "missing.enc"), filepath.Join(dir, "eredes.key"))
+	require.Error(t, err)
+}
+
+// Vault with a KV v1 secret at kv/eredes, a KV v2 one at secret/eredes and
+// an AppRole login
+type testVault struct {
+	sync.Mutex
+	password string
+	logins   int
+	reads    map[string]int
+}
+
+func (v *testVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.Lock()
+	defer v.Unlock()
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		var login map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["role_id"] != "role" || login["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		v.logins++
+		fmt.Fprintf(w, `{"auth":{"client_token":"approle-token-%d","lease_duration":3600}}`, v.logins)
+		return
+	}
+
+	token := r.Header.Get("X-Vault-Token")
+	if token != "static-token" && token != fmt.Sprintf("approle-token-%d", v.logins) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	v.reads[r.URL.Path]++
+	switch r.URL.Path {
+	case "/v1/kv/eredes":
+		fmt.Fprintf(w, `{"data":{"user":"me@example.com","pass":%q},"lease_duration":3600}`, v.password)
+	case "/v1/secret/data/eredes":
+		fmt.Fprintf(w, `{"data":{"data":{"user":"me@example.com","pass":%q},"metadata":{"version":3}},"lease_duration":0}`, v.password)
+	case "/v1/kv/incomplete":
+		fmt.Fprint(w, `{"data":{"user":"me@example.com"},"lease_duration":3600}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestVaultCredentials(t *testing.T) {
+	vault := &testVault{password: "first", reads: make(map[string]int)}
+	ts := httptest.NewServer(vault)
+	defer ts.Close()
+
+	newVault := func(path string, token string, secretID string) *vaultCredentials {
+		return &vaultCredentials{
+			address:     ts.URL + "/",
+			path:        path,
+			token:       token,
+			roleID:      "role",
+			secretID:    secretID,
+			usernameKey: "user",
+			passwordKey: "pass",
+			client:      ts.Client(),
+		}
+	}
+	get := func(v *vaultCredentials) string {
+		username, password, err := v.get()
+		require.NoError(t, err)
+		require.Equal(t, "me@example.com", username)
+		return password
+	}
+	rotate := func(password string) {
+		vault.Lock()
+		vault.password = password
+		vault.Unlock()
+	}
+
+	t.Run("kv v1 lease", func(t *testing.T) {
+		rotate("first")
+		v := newVault("kv/eredes", "static-token", "")
+		assert.Equal(t, "first", get(v))
+
+		// Cached until the lease expires
+		rotate("second")
+		assert.Equal(t, "first", get(v))
+		assert.Equal(t, 1, vault.reads["/v1/kv/eredes"])
+
+		v.expires = time.Now().Add(-time.Second)
+		assert.Equal(t, "second", get(v))
+		assert.Equal(t, 2, vault.reads["/v1/kv/eredes"])
+	})
+
+	t.Run("kv v2 without lease", func(t *testing.T) {
+		rotate("first")
+		v := newVault("/secret/data/eredes", "static-token", "")
+		assert.Equal(t, "first", get(v))
+
+		// Read on every sign in
+		rotate("second")
+		assert.Equal(t, "second", get(v))
+		assert.Equal(t, 2, vault.reads["/v1/secret/data/eredes"])
+	})
+
+	t.Run("approle", func(t *testing.T) {
+		rotate("first")
+		v := newVault("secret/data/eredes", "", "secret")
+		assert.Equal(t, "first", get(v))
+		assert.Equal(t, "first", get(v))
+		assert.Equal(t, 1, vault.logins)
+
+		// Logs in again once the login token expires
+		v.loginTokenExpires = time.Now().Add(-time.Second)
+		assert.Equal(t, "first", get(v))
+		assert.Equal(t, 2, vault.logins)
+		assert.Equal(t, "approle-token-2", v.loginToken)
+	})
+
+	failures := []struct {
+		name  string
+		vault *vaultCredentials
+		err   string
+	}{
+		{"approle wrong secret", newVault("kv/eredes", "", "wrong"), "vault login: received status code 400"},
+		{"wrong token", newVault("kv/eredes", "wrong-token", ""), "vault read kv/eredes: received status code 403"},
+		{"missing secret", newVault("kv/missing", "static-token", ""), "received status code 404"},
+		{"missing keys", newVault("kv/incomplete", "static-token", ""), `doesn't have the "user" and "pass" keys`},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.vault.get()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestPlanRequests(t *testing.T) {
+	// Fields planned per CPE, in a fixed order
+	describe := func(p *cpePlan) string {
+		var planned []string
+		if len(p.windows) > 0 {
+			planned = append(planned, fmt.Sprintf("windows=%d", len(p.windows)))
+		}
+		if p.daily {
+			planned = append(planned, "daily")
+		}
+		if p.maxPower {
+			planned = append(planned, "maxPower")
+		}
+		if p.contract {
+			planned = append(planned, "contract")
+		}
+		return strings.Join(planned, " ")
+	}
+
+	tests := []struct {
+		name      string
+		max       int
+		spent     int
+		injection bool
+		dailyDone bool
+		expected  map[string]string
+	}{
+		{
+			name:     "no cap",
+			expected: map[string]string{"A": "windows=1 daily maxPower contract", "B": "windows=3 daily maxPower contract"},
+		},
+		{
+			name:     "only the sign in fits",
+			max:      2,
+			expected: map[string]string{"A": "", "B": ""},
+		},
+		{
+			name:     "fresh window first",
+			max:      3,
+			expected: map[string]string{"A": "windows=1", "B": ""},
+		},
+		{
+			name:     "then the daily totals",
+			max:      5,
+			expected: map[string]string{"A": "windows=1 daily", "B": "daily"},
+		},
+		{
+			name:     "then max power",
+			max:      7,
+			expected: map[string]string{"A": "windows=1 daily maxPower", "B": "daily maxPower"},
+		},
+		{
+			name:     "then the contract",
+			max:      9,
+			expected: map[string]string{"A": "windows=1 daily maxPower contract", "B": "daily maxPower contract"},
+		},
+		{
+			name:     "backfill last",
+			max:      11,
+			expected: map[string]string{"A": "windows=1 daily maxPower contract", "B": "windows=2 daily maxPower contract"},
+		},
+		{
+			name:     "requests made today count",
+			max:      10,
+			spent:    5,
+			expected: map[string]string{"A": "windows=1 daily", "B": "daily"},
+		},
+		{
+			name:      "cheaper requests fit after a deferred window",
+			max:       3,
+			injection: true,
+			expected:  map[string]string{"A": "daily", "B": ""},
+		},
+		{
+			name:      "daily totals fetched today",
+			max:       5,
+			dailyDone: true,
+			expected:  map[string]string{"A": "windows=1 maxPower", "B": "maxPower"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			eredes := &EREDES{
+				HistoryInterval:    internal.Duration{Duration: 24 * time.Hour},
+				CatchUpWindow:      internal.Duration{Duration: 24 * time.Hour},
+				CatchUpMaxRequests: 3,
+				MaxDailyRequests:   tt.max,
+				IncludeInjection:   tt.injection,
+				DailyTotals:        true,
+				MaxPower:           true,
+				ContractMetadata:   true,
+				location:           time.UTC,
+				state:              newState(),
+			}
+			for i := 0; i < tt.spent; i++ {
+				eredes.state.countRequest()
+			}
+
+			// A is up to date, B three days behind
+			require.NoError(t, eredes.state.setWatermark("B", eredes.publishedUntil().AddDate(0, 0, -3), ""))
+
+			s := &session{eredes: eredes, name: "account"}
+			if tt.dailyDone {
+				s.dailyFetched.done("A")
+				s.dailyFetched.done("B")
+			}
+
+			plans := eredes.planRequests(s, []string{"A", "B"})
+			planned := make(map[string]string)
+			for cpe, p := range plans {
+				planned[cpe] = describe(p)
+			}
+			assert.Equal(t, tt.expected, planned)
+		})
+	}
+}
+
+func TestSignInBudget(t *testing.T) {
+	eredes := &EREDES{
+		MaxDailyRequests: 3,
+		state:            newState(),
+	}
+	for i := 0; i < 3; i++ {
+		eredes.state.countRequest()
+	}
+
+	s := &session{eredes: eredes, name: "account", username: "user", password: "secret"}
+	a := &passwordAuthenticator{session: s, refreshToken: "refresh"}
+
+	_, err := a.SignIn()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "max_daily_requests (3) reached")
+	assert.Equal(t, 3, eredes.state.requestsToday())
+}
+
+func TestAggregates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	newPlugin := func() *EREDES {
+		state, err := loadState(stateFile)
+		require.NoError(t, err)
+		return &EREDES{
+			Aggregates:  true,
+			ReadingType: "quarter_hourly",
+			StateFile:   stateFile,
+			location:    time.UTC,
+			state:       state,
+		}
+	}
+
+	// Two readings per day of the week from Monday 2024-01-15
+	monday := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	days := func(from int, to int) []Reading {
+		var readings []Reading
+		for i := from; i <= to; i++ {
+			day := monday.AddDate(0, 0, i)
+			readings = append(readings,
+				Reading{Cpe: "A", Time: day.Add(12 * time.Hour), Kwh: 0.25},
+				Reading{Cpe: "A", Time: day.Add(12*time.Hour + 15*time.Minute), Kwh: 0.5, Direction: "consumption"},
+				Reading{Cpe: "A", Time: day.Add(12 * time.Hour), Kwh: 1, Direction: "injection"},
+			)
+		}
+		return readings
+	}
+
+	// Measurements emitted and the fields of the weeks
+	emitted := func(acc *testutil.Accumulator) (map[string]int, []map[string]interface{}) {
+		counts := make(map[string]int)
+		var weeks []map[string]interface{}
+		for _, m := range acc.Metrics {
+			counts[m.Measurement]++
+			if m.Measurement == "eredes_weekly" {
+				assert.Equal(t, monday, m.Time)
+				weeks = append(weeks, m.Fields)
+			}
+		}
+		return counts, weeks
+	}
+
+	week := map[string]interface{}{"kwh": 5.25, "avg_power_kw": 1.5, "days": 7}
+
+	// Monday to Saturday, the week isn't complete
+	plugin := newPlugin()
+	acc := &testutil.Accumulator{}
+	plugin.addAggregates(acc, "A", days(0, 5))
+	counts, weeks := emitted(acc)
+	assert.Equal(t, map[string]int{"eredes_daily_aggregate": 6}, counts)
+	assert.Empty(t, weeks)
+
+	for _, m := range acc.Metrics {
+		assert.Equal(t, map[string]interface{}{"kwh": 0.75, "avg_power_kw": 1.5, "points": 2}, m.Fields)
+	}
+
+	// Sunday completes it
+	acc = &testutil.Accumulator{}
+	plugin.addAggregates(acc, "A", days(6, 6))
+	counts, weeks = emitted(acc)
+	assert.Equal(t, map[string]int{"eredes_daily_aggregate": 1, "eredes_weekly": 1}, counts)
+	assert.Equal(t, []map[string]interface{}{week}, weeks)
+
+	// After a restart, Sunday requested again still has the whole week
+	plugin = newPlugin()
+	acc = &testutil.Accumulator{}
+	plugin.addAggregates(acc, "A", days(6, 6))
+	_, weeks = emitted(acc)
+	assert.Equal(t, []map[string]interface{}{week}, weeks)
+
+	// Days more than two weeks behind the newest are forgotten
+	plugin.addAggregates(&testutil.Accumulator{}, "A", days(20, 20))
+	totals := plugin.state.dayTotals("A")
+	assert.Len(t, totals, 2)
+	assert.NotContains(t, totals, "2024-01-20")
+	assert.Contains(t, totals, "2024-01-21")
+}
+
+func TestTransform(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+
+	eredes := &EREDES{
+		TransformCommand: []string{"/bin/sh", "-c", `echo '[{"v": 1, "ts": "2021-01-15T12:15:00Z", "kwh": 0.125}]'`},
+		TransformTimeout: internal.Duration{Duration: 5 * time.Second},
+	}
+	readings, err := eredes.transform([]byte("{}"))
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 0.125, readings[0].Kwh)
+	assert.Equal(t, time.Date(2021, 1, 15, 12, 15, 0, 0, time.UTC), readings[0].Time.UTC())
+
+	eredes.TransformCommand = []string{"/bin/sh", "-c", "echo broken >&2; exit 3"}
+	_, err = eredes.transform([]byte("{}"))
+	require.Error(t, err)
+	assert.Equal(t, "transform_command: exit status 3: broken", err.Error())
+}
+
+func TestTransformTimeout(t *testing.T) {
+	if _, err := os.Stat("/bin/sleep"); err != nil {
+		t.Skip("no /bin/sleep")
+	}
+
+	// The shell leaves a grandchild holding stdout, killing only the shell
+	// would wait for it
+	eredes := &EREDES{
+		TransformCommand: []string{"/bin/sh", "-c", "/bin/sleep 30 & wait"},
+		TransformTimeout: internal.Duration{Duration: 100 * time.Millisecond},
+	}
+
+	start := time.Now()
+	_, err := eredes.transform([]byte("{}"))
+	require.Error(t, err)
+	assert.Equal(t, "transform_command timed out after 100ms", err.Error())
+	assert.True(t, time.Since(start) < 10*time.Second, "transform took %s", time.Since(start))
+}
+
+// GET a URL over a dialer, returns the body
+func dialGet(dial dialFunc, url string) (string, error) {
+	client := &http.Client{Transport: &http.Transport{DialContext: dial}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// SOCKS5 proxy without authentication that connects every request to
+// target and records the addresses it was asked for
+type socksProxy struct {
+	listener  net.Listener
+	target    string
+	lock      sync.Mutex
+	addresses []string
+}
+
+func newSocksProxy(t *testing.T, target string) *socksProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	p := &socksProxy{listener: listener, target: target}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *socksProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting, no authentication
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Connect request, to an IPv4 address or a host name
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	p.addresses = append(p.addresses, net.JoinHostPort(host, fmt.Sprint(int(port[0])<<8|int(port[1]))))
+	p.lock.Unlock()
+
+	target, err := net.Dial("tcp", p.target)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(target, conn)
+	}()
+	_, _ = io.Copy(conn, target)
+}
+
+func TestDialer(t *testing.T) {
+	var lock sync.Mutex
+	var remotes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		remotes = append(remotes, r.RemoteAddr)
+		lock.Unlock()
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	require.NoError(t, err)
+
+	t.Run("host_overrides", func(t *testing.T) {
+		eredes := &EREDES{HostOverrides: map[string]string{"portal.example": "127.0.0.1"}}
+		dial, err := eredes.dialer()
+		require.NoError(t, err)
+
+		body, err := dialGet(dial, "http://portal.example:"+port+"/")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", body)
+
+		eredes.HostOverrides["portal.example"] = "not an ip"
+		_, err = eredes.dialer()
+		assert.EqualError(t, err, `host_overrides: invalid IP "not an ip" of portal.example`)
+	})
+
+	t.Run("ip_family", func(t *testing.T) {
+		eredes := &EREDES{IPFamily: "ipv4"}
+		dial, err := eredes.dialer()
+		require.NoError(t, err)
+		_, err = dialGet(dial, ts.URL)
+		require.NoError(t, err)
+
+		// An IPv4 address can't be reached over IPv6
+		eredes.IPFamily = "ipv6"
+		dial, err = eredes.dialer()
+		require.NoError(t, err)
+		_, err = dialGet(dial, ts.URL)
+		require.Error(t, err)
+
+		eredes.IPFamily = "ipv5"
+		_, err = eredes.dialer()
+		assert.EqualError(t, err, `invalid ip_family "ipv5", expected ipv4, ipv6 or any`)
+	})
+
+	t.Run("local_address", func(t *testing.T) {
+		eredes := &EREDES{LocalAddress: "not an ip"}
+		_, err := eredes.dialer()
+		assert.EqualError(t, err, `invalid local_address "not an ip"`)
+
+		// The whole 127.0.0.0/8 is local on Linux, not everywhere
+		if l, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+			t.Skip("127.0.0.2 isn't a local address")
+		} else {
+			l.Close()
+		}
+
+		eredes.LocalAddress = "127.0.0.2"
+		dial, err := eredes.dialer()
+		require.NoError(t, err)
+		_, err = dialGet(dial, ts.URL)
+		require.NoError(t, err)
+
+		lock.Lock()
+		remote := remotes[len(remotes)-1]
+		lock.Unlock()
+		host, _, err := net.SplitHostPort(remote)
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.2", host)
+	})
+
+	t.Run("socks5", func(t *testing.T) {
+		proxy := newSocksProxy(t, ts.Listener.Addr().String())
+		defer proxy.listener.Close()
+
+		// The proxy gets the host name, or its override
+		eredes := &EREDES{Socks5ProxyAddr: proxy.listener.Addr().String()}
+		dial, err := eredes.dialer()
+		require.NoError(t, err)
+		body, err := dialGet(dial, "http://portal.example:"+port+"/")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", body)
+
+		eredes.HostOverrides = map[string]string{"portal.example": "192.0.2.10"}
+		dial, err = eredes.dialer()
+		require.NoError(t, err)
+		_, err = dialGet(dial, "http://portal.example:"+port+"/")
+		require.NoError(t, err)
+
+		proxy.lock.Lock()
+		assert.Equal(t, []string{"portal.example:" + port, "192.0.2.10:" + port}, proxy.addresses)
+		proxy.lock.Unlock()
+
+		eredes.IPFamily = "ipv4"
+		_, err = eredes.dialer()
+		assert.EqualError(t, err, "ip_family can't be used with socks5_proxy_addr, the proxy resolves the portal hosts")
+	})
+}
+
+func TestCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newPlugin := func() *EREDES {
+		jar, err := newRecordingJar()
+		require.NoError(t, err)
+		return &EREDES{
+			CookieFile: filepath.Join(dir, "cookies.json"),
+			sessions:   []*session{{name: "default", jar: jar}},
+		}
+	}
+
+	signIn, err := url.Parse("https://portal.example/api/auth/signin")
+	require.NoError(t, err)
+	usage, err := url.Parse("https://portal.example/api/usage")
+	require.NoError(t, err)
+
+	// Names of the cookies the jar sends with a request
+	sent := func(plugin *EREDES, u *url.URL) []string {
+		var names []string
+		for _, c := range plugin.sessions[0].jar.Cookies(u) {
+			names = append(names, c.Name+"="+c.Value)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	plugin := newPlugin()
+	plugin.sessions[0].jar.SetCookies(signIn, []*http.Cookie{
+		{Name: "session", Value: "a"},
+		{Name: "remember", Value: "b", MaxAge: 3600},
+		{Name: "auth", Value: "c", Path: "/api/auth"},
+		{Name: "old", Value: "d", Expires: time.Now().Add(-time.Hour)},
+	})
+	// Deleted by the portal
+	plugin.sessions[0].jar.SetCookies(usage, []*http.Cookie{{Name: "remember", Value: "", Path: "/api/auth", MaxAge: -1}})
+	require.NoError(t, plugin.saveCookies())
+
+	// The file only has the live cookies, with their path and expiry
+	content, err := ioutil.ReadFile(plugin.CookieFile)
+	require.NoError(t, err)
+	var stored storedCookies
+	require.NoError(t, json.Unmarshal(content, &stored))
+	cookies := stored["default"]["https://portal.example"]
+	sort.Slice(cookies, func(i, j int) bool { return cookies[i].Name < cookies[j].Name })
+	assert.Equal(t, []storedCookie{
+		{Name: "auth", Value: "c", Path: "/api/auth"},
+		{Name: "session", Value: "a", Path: "/api/auth"},
+	}, cookies)
+
+	// Restored after a restart, with their path
+	plugin = newPlugin()
+	require.NoError(t, plugin.loadCookies(plugin.sessions[0]))
+	assert.Equal(t, []string{"auth=c", "session=a"}, sent(plugin, signIn))
+	assert.Empty(t, sent(plugin, usage))
+
+	// Cookies that expired while stopped aren't restored
+	stored["default"]["https://portal.example"] = []storedCookie{
+		{Name: "live", Value: "e", Path: "/", Expires: time.Now().Add(time.Hour)},
+		{Name: "stale", Value: "f", Path: "/", Expires: time.Now().Add(-time.Minute)},
+	}
+	content, err = json.Marshal(stored)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(plugin.CookieFile, content, 0600))
+
+	plugin = newPlugin()
+	require.NoError(t, plugin.loadCookies(plugin.sessions[0]))
+	assert.Equal(t, []string{"live=e"}, sent(plugin, usage))
+	require.NoError(t, plugin.saveCookies())
+
+	// Written through a temporary file, nothing is left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "cookies.json", files[0].Name())
+}
+
+// One winter weekday at 6.9 kVA, the readings in every period of the daily
+// cycle: vazio 2.2 kWh (03:00 and 23:00), ponta 0.5 kWh (09:30) and cheias
+// 0.8 kWh (14:00), 3.5 kWh in total. The bi-hourly tariff prices fora de
+// vazio (cheias and ponta) at 0.1940.
+func TestCostWorkedExample(t *testing.T) {
+	day := time.Date(2024, 1, 15, 0, 0, 0, 0, lisbon)
+	readings := []Reading{
+		{Time: day.Add(3 * time.Hour), Kwh: 1.0},
+		{Time: day.Add(9*time.Hour + 30*time.Minute), Kwh: 0.5},
+		{Time: day.Add(14 * time.Hour), Kwh: 0.8},
+		{Time: day.Add(23 * time.Hour), Kwh: 1.2},
+	}
+	simple := Tariff{Simple: 0.1658, DailyCharge: 0.3205}
+	biHourly := Tariff{Vazio: 0.0967, Cheias: 0.1940, Ponta: 0.1940, DailyCharge: 0.3205}
+
+	// Above 3.45 kVA the daily charge has the normal IVA
+	taxes := &Taxes{IVA: 0.23, ReducedIVA: 0.06, ReducedIVAKwh: 100, IEC: 0.001, DGEG: 0.07, CAV: 2.85}
+	simpleTaxed := simple
+	simpleTaxed.Taxes = taxes
+	biHourlyTaxed := biHourly
+	biHourlyTaxed.Taxes = taxes
+
+	tests := []struct {
+		name   string
+		tariff Tariff
+		cycle  string
+		// Per reading and of the day
+		readings []float64
+		fields   map[string]interface{}
+	}{
+		{
+			// 3.5 × 0.1658 = 0.5803 + 0.3205
+			name:     "simple",
+			tariff:   simple,
+			readings: []float64{0.1658, 0.0829, 0.13264, 0.19896},
+			fields:   map[string]interface{}{"estimated_cost_eur": 0.9008},
+		},
+		{
+			// 2.2 × 0.0967 = 0.21274, 1.3 × 0.1940 = 0.2522, + 0.3205
+			name:     "bi-hourly",
+			tariff:   biHourly,
+			cycle:    "daily",
+			readings: []float64{0.0967, 0.097, 0.1552, 0.11604},
+			fields:   map[string]interface{}{"estimated_cost_eur": 0.78544},
+		},
+		{
+			// IEC: 3.5 × 0.001 = 0.0035
+			// IVA of energy and IEC: 100 / 30 = 3.3333 kWh of 3.5 (20/21)
+			// at 6%, the rest at 23%: (0.5803 + 0.0035) × 1.43 / 21 = 0.039754
+			// IVA of the daily charge: 0.3205 × 0.23 = 0.073715
+			// DGEG: 0.07 × 12 / 365 × 1.23 = 0.00283068
+			// CAV: 2.85 × 12 / 365 × 1.06 = 0.09932055
+			// Taxes: 0.21912023, total: 0.9008 + 0.21912023
+			name:     "simple with taxes",
+			tariff:   simpleTaxed,
+			readings: []float64{0.1658, 0.0829, 0.13264, 0.19896},
+			fields:   map[string]interface{}{"taxes_eur": 0.21912023, "estimated_cost_eur": 1.11992023},
+		},
+		{
+			// IVA of energy and IEC: (0.46494 + 0.0035) × 1.43 / 21 = 0.03189853,
+			// the rest as above
+			// Taxes: 0.21126476, total: 0.78544 + 0.21126476
+			name:     "bi-hourly with taxes",
+			tariff:   biHourlyTaxed,
+			cycle:    "daily",
+			readings: []float64{0.0967, 0.097, 0.1552, 0.11604},
+			fields:   map[string]interface{}{"taxes_eur": 0.21126476, "estimated_cost_eur": 0.99670476},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tariff := tt.tariff
+			eredes := &EREDES{
+				Tariff:          &tariff,
+				TariffCycle:     tt.cycle,
+				ReadingType:     "quarter_hourly",
+				location:        lisbon,
+				tariffSchedules: erseTariffSchedules,
+			}
+
+			costs := make(dailyCosts)
+			var perReading []float64
+			for _, r := range readings {
+				tags := make(map[string]string)
+				fields := make(map[string]interface{})
+				eredes.tagTariffPeriod(tags, "A", r.Time)
+				eredes.addCost(costs, tags, fields, r)
+				perReading = append(perReading, fields["estimated_cost_eur"].(float64))
+			}
+			assert.InDeltaSlice(t, tt.readings, perReading, 1e-9)
+
+			var acc testutil.Accumulator
+			eredes.addDailyCosts(&acc, "A", costs)
+			require.Len(t, acc.Metrics, 1)
+			m := acc.Metrics[0]
+			assert.Equal(t, "eredes_cost", m.Measurement)
+			assert.Equal(t, day, m.Time)
+			require.Len(t, m.Fields, len(tt.fields))
+			for key, expected := range tt.fields {
+				assert.InDelta(t, expected, m.Fields[key], 1e-8, key)
+			}
+		})
+	}
+}
+
+func TestDailyPeak(t *testing.T) {
+	eredes := &EREDES{
+		DailyPeak:   true,
+		ReadingType: "quarter_hourly",
+		location:    lisbon,
+		state:       newState(),
+	}
+
+	// The first of equal peaks, injection doesn't count
+	day := time.Date(2024, 1, 15, 0, 0, 0, 0, lisbon)
+	var acc testutil.Accumulator
+	eredes.addAggregates(&acc, "A", []Reading{
+		{Time: day.Add(8 * time.Hour), Kwh: 0.5},
+		{Time: day.Add(19 * time.Hour), Kwh: 0.75},
+		{Time: day.Add(20 * time.Hour), Kwh: 0.75},
+		{Time: day.Add(12 * time.Hour), Kwh: 2, Direction: "injection"},
+	})
+
+	require.Len(t, acc.Metrics, 1)
+	m := acc.Metrics[0]
+	assert.Equal(t, "eredes_daily_peak", m.Measurement)
+	assert.Equal(t, day, m.Time)
+	assert.Equal(t, map[string]interface{}{
+		"peak_kw": 3.0,
+		"peak_at": day.Add(19 * time.Hour).Unix(),
+	}, m.Fields)
+}
+
+// Transport of the portal requests built by Init
+func initTransport(t *testing.T, eredes *EREDES) *http.Transport {
+	eredes.Cpe = "PT0002000000000000XX"
+	require.NoError(t, eredes.Init())
+	require.NotEmpty(t, eredes.sessions)
+	client, ok := eredes.sessions[0].client.(*http.Client)
+	require.True(t, ok)
+	transport, ok := client.Transport.(*http.Transport)
+	require.True(t, ok)
+	return transport
+}
+
+func TestTransportConnections(t *testing.T) {
+	transport := initTransport(t, &EREDES{})
+	assert.False(t, transport.DisableKeepAlives)
+	assert.Zero(t, transport.IdleConnTimeout)
+	assert.Zero(t, transport.MaxIdleConns)
+	assert.Zero(t, transport.MaxIdleConnsPerHost)
+
+	transport = initTransport(t, &EREDES{
+		IdleConnTimeout:   internal.Duration{Duration: 30 * time.Second},
+		MaxIdleConns:      4,
+		DisableKeepAlives: true,
+	})
+	assert.True(t, transport.DisableKeepAlives)
+	assert.Equal(t, 30*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 4, transport.MaxIdleConns)
+	assert.Equal(t, 4, transport.MaxIdleConnsPerHost)
+}
+
+func TestTransportForceHTTP1(t *testing.T) {
+	transport := initTransport(t, &EREDES{})
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Nil(t, transport.TLSNextProto)
+
+	// A non-nil empty TLSNextProto is what turns HTTP/2 off
+	transport = initTransport(t, &EREDES{ForceHTTP1: true})
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.NotNil(t, transport.TLSNextProto)
+	assert.Empty(t, transport.TLSNextProto)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	transport.TLSClientConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1", string(body))
+}
@@ -1,3 +1,1008 @@
 package eredes_test
 
-// TODO :)
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/internal"
+	"github.com/influxdata/telegraf/plugins/inputs/eredes"
+	"github.com/influxdata/telegraf/plugins/parsers"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Readings of yesterday, the day requested by default
+var yesterday = time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+
+var usageResponse = `{"Body":{"Result":{"utilitiesDevices":[{"meterLoadCurves":[{"loadCurves":[
+	{"loadCurveTimestamp":"` + yesterday + `T12:15:00Z","meterLoadCurve":"0.125"},
+	{"loadCurveTimestamp":"` + yesterday + `T12:30:00Z","meterLoadCurve":"0.250"}
+]}]}]}}}`
+
+type fakeAuthenticator struct {
+	token string
+}
+
+func (a *fakeAuthenticator) SignIn() (string, error) {
+	return a.token, nil
+}
+
+// Answers every request with the same body and records the requests
+type fakeDoer struct {
+	body     string
+	requests []*http.Request
+}
+
+func (d *fakeDoer) Do(req *http.Request) (*http.Response, error) {
+	d.requests = append(d.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(d.body)),
+	}, nil
+}
+
+func newParser(t *testing.T) parsers.Parser {
+	parser, err := parsers.NewParser(&parsers.Config{
+		DataFormat:       "json",
+		MetricName:       "eredes",
+		JSONQuery:        "Body.Result.utilitiesDevices.0.meterLoadCurves.0.loadCurves",
+		JSONTimeKey:      "loadCurveTimestamp",
+		JSONTimeFormat:   "2006-01-02T15:04:05Z",
+		JSONStringFields: []string{"meterLoadCurve"},
+	})
+	require.NoError(t, err)
+	return parser
+}
+
+func TestGatherUsages(t *testing.T) {
+	doer := &fakeDoer{body: usageResponse}
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		CpeAliases:      map[string]string{"PT0002000000000000XX": "house"},
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Client:          doer,
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	plugin.SetParser(newParser(t))
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Len(t, doer.requests, 1)
+	require.Equal(t, "Bearer TOKEN1234567890", doer.requests[0].Header.Get("Authorization"))
+
+	require.Len(t, acc.Metrics, 3)
+	require.Equal(t, "0.125", acc.Metrics[0].Fields["meterLoadCurve"])
+	require.Equal(t, "house", acc.Metrics[0].Tags["name"])
+
+	status := acc.Metrics[2]
+	require.Equal(t, "eredes_status", status.Measurement)
+	require.Equal(t, "house", status.Tags["name"])
+	require.Equal(t, "idle", status.Fields["state"])
+	require.Equal(t, true, status.Fields["healthy"])
+}
+
+func TestGatherUsagesBuiltinParser(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Client:          &fakeDoer{body: usageResponse},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Len(t, acc.Metrics, 3)
+	require.Equal(t, "eredes", acc.Metrics[0].Measurement)
+	require.Equal(t, map[string]interface{}{"kwh": 0.125}, acc.Metrics[0].Fields)
+	require.Equal(t, yesterday+"T12:15:00Z", acc.Metrics[0].Time.UTC().Format(time.RFC3339))
+}
+
+func TestGatherUsagesBuiltinParserUnit(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Unit:            "kwh",
+		Client:          &fakeDoer{body: usageResponse},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	// The built-in parser readings are already in kWh
+	require.Equal(t, map[string]interface{}{"kwh": 0.125}, acc.Metrics[0].Fields)
+}
+
+func TestGatherUsagesMissingField(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Client:          &fakeDoer{body: strings.Replace(usageResponse, `"meterLoadCurve":"0.250"`, `"value":"0.250"`, 1)},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+
+	require.Len(t, acc.Errors, 1)
+	require.Contains(t, acc.Errors[0].Error(), "field 'meterLoadCurve' missing at index 1")
+}
+
+func TestGatherUsagesConsumptionField(t *testing.T) {
+	// Other numeric fields aren't counted as consumption
+	body := strings.Replace(usageResponse, `"meterLoadCurve":"0.125"`, `"meterLoadCurve":"0.125","id":7`, 1)
+	plugin := &eredes.EREDES{
+		Cpe:               "PT0002000000000000XX",
+		HistoryInterval:   internal.Duration{Duration: 24 * time.Hour},
+		CumulativeCounter: true,
+		Client:            &fakeDoer{body: body},
+		Authenticator:     &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	plugin.SetParser(newParser(t))
+	require.NoError(t, plugin.Init())
+	require.Equal(t, "meterLoadCurve", plugin.ConsumptionField)
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, 0.125, acc.Metrics[0].Fields["consumption_total_kwh"])
+	require.Equal(t, 0.375, acc.Metrics[1].Fields["consumption_total_kwh"])
+
+	// A reading without the field fails the window
+	plugin = &eredes.EREDES{
+		Cpe:              "PT0002000000000000XX",
+		HistoryInterval:  internal.Duration{Duration: 24 * time.Hour},
+		ConsumptionField: "value",
+		Client:           &fakeDoer{body: usageResponse},
+		Authenticator:    &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	plugin.SetParser(newParser(t))
+	require.NoError(t, plugin.Init())
+
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Contains(t, acc.Errors[0].Error(), "no value field in the reading at "+yesterday+"T12:15:00Z, see consumption_field")
+	require.Empty(t, readingDays(&acc))
+}
+
+func TestGatherUsagesEmptyReading(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Client:          &fakeDoer{body: strings.Replace(usageResponse, `"meterLoadCurve":"0.250"`, `"meterLoadCurve":""`, 1)},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []string{yesterday}, readingDays(&acc))
+	require.Equal(t, map[string]interface{}{"kwh": 0.125}, acc.Metrics[0].Fields)
+}
+
+// Portal that hands out a token and a session cookie per account and only
+// answers usage requests that carry both for the same account
+func newPortal(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/signin":
+			body, err := ioutil.ReadAll(r.Body)
+			if !assert.NoError(t, err) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			username := strings.Split(strings.Split(string(body), `"username": "`)[1], `"`)[0]
+
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: username})
+			fmt.Fprintf(w, `{"Body":{"Result":{"token":"token-%s"}}}`, username)
+		case "/usage":
+			session, err := r.Cookie("session")
+			if err != nil || r.Header.Get("Authorization") != "Bearer token-"+session.Value {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			value := map[string]string{"house": "0.125", "garage": "0.250"}[session.Value]
+			fmt.Fprintf(w, `{"Body":{"Result":{"utilitiesDevices":[{"meterLoadCurves":[{"loadCurves":[
+				{"loadCurveTimestamp":"%sT12:15:00Z","meterLoadCurve":"%s"}
+			]}]}]}}}`, yesterday, value)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestConcurrentAccounts(t *testing.T) {
+	portal := newPortal(t)
+	defer portal.Close()
+
+	expected := map[string]string{"house": "0.125", "garage": "0.250"}
+
+	var wg sync.WaitGroup
+	for username, value := range expected {
+		plugin := &eredes.EREDES{
+			SignInURL: portal.URL + "/signin",
+			UsageURL:  portal.URL + "/usage",
+			Username:  username,
+			Password:  "password",
+			Cpe:       "PT0002000000000000XX",
+
+			HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		}
+		plugin.SetParser(newParser(t))
+		require.NoError(t, plugin.Init())
+
+		wg.Add(1)
+		go func(plugin *eredes.EREDES, value string) {
+			defer wg.Done()
+
+			for i := 0; i < 3; i++ {
+				var acc testutil.Accumulator
+				if !assert.NoError(t, plugin.Gather(&acc)) || !assert.Empty(t, acc.Errors) || !assert.NotEmpty(t, acc.Metrics) {
+					return
+				}
+				assert.Equal(t, value, acc.Metrics[0].Fields["meterLoadCurve"])
+			}
+		}(plugin, value)
+	}
+	wg.Wait()
+}
+
+// Fails the usage requests of one CPE
+type failingCpeDoer struct {
+	cpe string
+}
+
+func (d *failingCpeDoer) Do(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(string(body), d.cpe) {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(usageResponse)),
+	}, nil
+}
+
+func TestGatherUsagesPartialFailure(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpes:            []string{"PT0002000000000000XX", "PT0002000000000000YY"},
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Client:          &failingCpeDoer{cpe: "PT0002000000000000XX"},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	plugin.SetParser(newParser(t))
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+
+	require.Len(t, acc.Errors, 1)
+	require.Contains(t, acc.Errors[0].Error(), `cpe="PT0002000000000000XX"`)
+
+	var readings int
+	for _, m := range acc.Metrics {
+		if m.Measurement == "eredes" {
+			require.Equal(t, "PT0002000000000000YY", m.Tags["cpe"])
+			readings++
+		}
+	}
+	require.Equal(t, 2, readings)
+}
+
+func TestReadingSerialization(t *testing.T) {
+	reading := eredes.Reading{
+		Cpe:        "PT0002000000000000XX",
+		Time:       time.Date(2021, 1, 15, 12, 15, 0, 0, time.UTC),
+		Kwh:        0.125,
+		Direction:  "consumption",
+		Resolution: 15 * time.Minute,
+	}
+
+	b, err := json.Marshal(reading)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"v":1`)
+
+	var decoded eredes.Reading
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, reading, decoded)
+
+	require.Error(t, json.Unmarshal([]byte(`{"v":99,"cpe":"PT0002000000000000XX"}`), &decoded))
+}
+
+// Answers each usage request with a reading at noon of the day after the
+// start of the window, failing the requests listed
+type windowDoer struct {
+	fail     map[int]bool
+	requests int
+}
+
+func (d *windowDoer) Do(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	d.requests++
+	if d.fail[d.requests] {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+
+	start, err := time.Parse("2006-01-02", strings.Split(string(body), `"start_date":"`)[1][:10])
+	if err != nil {
+		return nil, err
+	}
+	day := start.AddDate(0, 0, 1).Format("2006-01-02")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body: ioutil.NopCloser(strings.NewReader(`{"Body":{"Result":{"utilitiesDevices":[{"meterLoadCurves":[{"loadCurves":[
+			{"loadCurveTimestamp":"` + day + `T12:15:00Z","meterLoadCurve":"0.125"}
+		]}]}]}}}`)),
+	}, nil
+}
+
+func readingDays(acc *testutil.Accumulator) []string {
+	var days []string
+	for _, m := range acc.Metrics {
+		if m.Measurement == "eredes" {
+			days = append(days, m.Time.UTC().Format("2006-01-02"))
+		}
+	}
+	return days
+}
+
+func TestGatherUsagesFailedCatchUpWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	doer := &windowDoer{fail: map[int]bool{1: true}}
+	plugin := &eredes.EREDES{
+		Cpe:                "PT0002000000000000XX",
+		HistoryInterval:    internal.Duration{Duration: 48 * time.Hour},
+		CatchUpWindow:      internal.Duration{Duration: 24 * time.Hour},
+		CatchUpMaxRequests: 2,
+		SkipEmitted:        true,
+		StateFile:          filepath.Join(dir, "state.json"),
+		Client:             doer,
+		Authenticator:      &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	// The first window fails, the second is left for the next cycle
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Empty(t, readingDays(&acc))
+	require.Equal(t, 1, doer.requests)
+
+	// Both windows are emitted once the first one succeeds
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	dayBefore := time.Now().AddDate(0, 0, -2).Format("2006-01-02")
+	require.Equal(t, []string{dayBefore, yesterday}, readingDays(&acc))
+
+	// Nothing is emitted again
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Empty(t, readingDays(&acc))
+}
+
+func TestCumulativeCounterEstimatedReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	doer := &fakeDoer{body: strings.Replace(usageResponse, `"meterLoadCurve":"0.125"`, `"meterLoadCurve":"0.125","loadCurveQuality":"E"`, 1)}
+	plugin := &eredes.EREDES{
+		Cpe:               "PT0002000000000000XX",
+		HistoryInterval:   internal.Duration{Duration: 24 * time.Hour},
+		QualityKey:        "loadCurveQuality",
+		DropEstimated:     true,
+		CumulativeCounter: true,
+		StateFile:         filepath.Join(dir, "state.json"),
+		Client:            doer,
+		Authenticator:     &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	totals := func(acc *testutil.Accumulator) []interface{} {
+		var totals []interface{}
+		for _, m := range acc.Metrics {
+			if m.Measurement == "eredes" {
+				totals = append(totals, m.Fields["consumption_total_kwh"])
+			}
+		}
+		return totals
+	}
+
+	// The reading after the estimated one isn't counted yet
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []interface{}{nil}, totals(&acc))
+
+	// Both are counted once the real reading replaces the estimated one
+	doer.body = usageResponse
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []interface{}{0.125, 0.375}, totals(&acc))
+
+	// Readings requested again aren't counted twice
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []interface{}{nil, nil}, totals(&acc))
+}
+
+func TestSkipEmittedEstimatedReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	doer := &fakeDoer{body: strings.Replace(usageResponse, `"meterLoadCurve":"0.125"`, `"meterLoadCurve":"0.125","loadCurveQuality":"E"`, 1)}
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		QualityKey:      "loadCurveQuality",
+		DropEstimated:   true,
+		SkipEmitted:     true,
+		StateFile:       filepath.Join(dir, "state.json"),
+		Client:          doer,
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	readings := func(acc *testutil.Accumulator) []string {
+		var readings []string
+		for _, m := range acc.Metrics {
+			if m.Measurement == "eredes" {
+				readings = append(readings, m.Time.UTC().Format("15:04"))
+			}
+		}
+		return readings
+	}
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []string{"12:30"}, readings(&acc))
+
+	// The real reading is emitted once it replaces the estimated one
+	doer.body = usageResponse
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []string{"12:15", "12:30"}, readings(&acc))
+
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Empty(t, readings(&acc))
+}
+
+func TestFillMissing(t *testing.T) {
+	doer := &fakeDoer{body: strings.Replace(usageResponse, `"meterLoadCurve":"0.125"`, `"meterLoadCurve":"0.125","loadCurveQuality":"R"`, 1)}
+	doer.body = strings.Replace(doer.body, `"meterLoadCurve":"0.250"`, `"meterLoadCurve":"0.250","loadCurveQuality":"R"`, 1)
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		CpeAliases:      map[string]string{"PT0002000000000000XX": "house"},
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Measurement:     "eredes_consumption",
+		QualityKey:      "loadCurveQuality",
+		FillMissing:     "zero",
+		Client:          doer,
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	// The whole day is filled, before the first reading and after the last
+	lisbon, err := time.LoadLocation("Europe/Lisbon")
+	require.NoError(t, err)
+	day, err := time.ParseInLocation("2006-01-02", yesterday, lisbon)
+	require.NoError(t, err)
+	periods := int(day.AddDate(0, 0, 1).Sub(day) / (15 * time.Minute))
+
+	var readings, filled int
+	for _, m := range acc.Metrics {
+		if m.Measurement == "eredes_status" {
+			continue
+		}
+		// Same series as the readings
+		require.Equal(t, "eredes_consumption", m.Measurement)
+		require.Equal(t, "house", m.Tags["name"])
+		require.Equal(t, "real", m.Tags["quality"])
+		require.False(t, m.Time.Before(day))
+		require.True(t, m.Time.Before(day.AddDate(0, 0, 1)))
+
+		if m.Fields["missing"] == true {
+			require.Equal(t, 0.0, m.Fields["kwh"])
+			filled++
+		} else {
+			readings++
+		}
+	}
+	require.Equal(t, 2, readings)
+	require.Equal(t, periods-2, filled)
+}
+
+// Portal preparing the usages in the background: a submit returns a job id,
+// and each poll of it answers the next status, the last one repeated. A
+// done job answers the usages.
+type asyncPortal struct {
+	sync.Mutex
+	statuses []string
+	submits  int
+	polled   []string
+}
+
+func (p *asyncPortal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+
+	switch r.URL.Path {
+	case "/usage":
+		p.submits++
+		fmt.Fprintf(w, `{"Body":{"Result":{"requestId":"job-%d"}}}`, p.submits)
+	case "/result":
+		var request struct {
+			ID string `json:"request_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p.polled = append(p.polled, request.ID)
+
+		status := p.statuses[0]
+		if len(p.statuses) > 1 {
+			p.statuses = p.statuses[1:]
+		}
+		switch status {
+		case "unknown":
+			w.WriteHeader(http.StatusNotFound)
+		case "done":
+			fmt.Fprint(w, strings.Replace(usageResponse, `{"Result":{`, `{"Result":{"status":"done",`, 1))
+		default:
+			fmt.Fprintf(w, `{"Body":{"Result":{"status":%q}}}`, status)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newAsyncPlugin(t *testing.T, portal *httptest.Server, stateFile string) *eredes.EREDES {
+	plugin := &eredes.EREDES{
+		Cpe:               "PT0002000000000000XX",
+		HistoryInterval:   internal.Duration{Duration: 24 * time.Hour},
+		UsageURL:          portal.URL + "/usage",
+		UsageResultURL:    portal.URL + "/result",
+		Async:             true,
+		AsyncIDPath:       "Body.Result.requestId",
+		AsyncStatusPath:   "Body.Result.status",
+		AsyncPollInterval: internal.Duration{Duration: 10 * time.Millisecond},
+		AsyncTimeout:      internal.Duration{Duration: 200 * time.Millisecond},
+		StateFile:         stateFile,
+		Authenticator:     &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	plugin.SetParser(newParser(t))
+	require.NoError(t, plugin.Init())
+	return plugin
+}
+
+// Job ids kept in the state file
+func stateJobs(t *testing.T, path string) []string {
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	var state struct {
+		Jobs map[string]struct {
+			ID string `json:"id"`
+		} `json:"jobs"`
+	}
+	require.NoError(t, json.Unmarshal(content, &state))
+
+	var ids []string
+	for _, job := range state.Jobs {
+		ids = append(ids, job.ID)
+	}
+	return ids
+}
+
+func TestGatherUsagesAsync(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		err      string
+		polls    int
+		readings int
+		jobs     []string
+	}{
+		{
+			name:     "done",
+			statuses: []string{"done"},
+			polls:    1,
+			readings: 2,
+		},
+		{
+			name:     "pending then done",
+			statuses: []string{"pending", "Processing", "running", "done"},
+			polls:    4,
+			readings: 2,
+		},
+		{
+			name:     "failed",
+			statuses: []string{"pending", "failed"},
+			err:      "usage job job-1 failed",
+			polls:    2,
+		},
+		{
+			name:     "timed out",
+			statuses: []string{"pending"},
+			err:      "usage job job-1 not ready after 200ms, polling it again next time",
+			polls:    4,
+			jobs:     []string{"job-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "eredes")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			p := &asyncPortal{statuses: tt.statuses}
+			portal := httptest.NewServer(p)
+			defer portal.Close()
+
+			plugin := newAsyncPlugin(t, portal, filepath.Join(dir, "state.json"))
+
+			var acc testutil.Accumulator
+			require.NoError(t, plugin.Gather(&acc))
+
+			if tt.err == "" {
+				require.Empty(t, acc.Errors)
+			} else {
+				require.Len(t, acc.Errors, 1)
+				require.Contains(t, acc.Errors[0].Error(), tt.err)
+			}
+			require.Len(t, readingDays(&acc), tt.readings)
+
+			require.Equal(t, 1, p.submits)
+			require.Len(t, p.polled, tt.polls)
+			require.Equal(t, tt.jobs, stateJobs(t, plugin.StateFile))
+		})
+	}
+}
+
+func TestGatherUsagesAsyncResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	p := &asyncPortal{statuses: []string{"pending"}}
+	portal := httptest.NewServer(p)
+	defer portal.Close()
+
+	// The job isn't ready before async_timeout, its id is kept
+	var acc testutil.Accumulator
+	require.NoError(t, newAsyncPlugin(t, portal, stateFile).Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Equal(t, []string{"job-1"}, stateJobs(t, stateFile))
+
+	// After a restart the same job is polled, not submitted again
+	p.Lock()
+	p.statuses = []string{"done"}
+	p.polled = nil
+	p.Unlock()
+
+	acc = testutil.Accumulator{}
+	require.NoError(t, newAsyncPlugin(t, portal, stateFile).Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, []string{yesterday, yesterday}, readingDays(&acc))
+	require.Equal(t, 1, p.submits)
+	require.Equal(t, []string{"job-1"}, p.polled)
+	require.Empty(t, stateJobs(t, stateFile))
+}
+
+func TestGatherUsagesAsyncResumeUnknown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eredes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	p := &asyncPortal{statuses: []string{"pending"}}
+	portal := httptest.NewServer(p)
+	defer portal.Close()
+
+	var acc testutil.Accumulator
+	require.NoError(t, newAsyncPlugin(t, portal, stateFile).Gather(&acc))
+	require.Equal(t, []string{"job-1"}, stateJobs(t, stateFile))
+
+	// The portal dropped the job, it's forgotten
+	p.Lock()
+	p.statuses = []string{"unknown"}
+	p.Unlock()
+
+	plugin := newAsyncPlugin(t, portal, stateFile)
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+	require.Equal(t, 1, p.submits)
+	require.Empty(t, stateJobs(t, stateFile))
+
+	// And the request submitted again
+	p.Lock()
+	p.statuses = []string{"done"}
+	p.Unlock()
+
+	acc = testutil.Accumulator{}
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+	require.Equal(t, 2, p.submits)
+	require.Equal(t, "job-2", p.polled[len(p.polled)-1])
+}
+
+func TestStatusPerAccount(t *testing.T) {
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/signin":
+			if strings.Contains(string(body), `"username": "garage"`) {
+				fmt.Fprint(w, `{"Body":{"Result":{"message":"Password expired"}}}`)
+				return
+			}
+			fmt.Fprint(w, `{"Body":{"Result":{"token":"token"}}}`)
+		case "/usage":
+			fmt.Fprint(w, usageResponse)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer portal.Close()
+
+	plugin := &eredes.EREDES{
+		SignInURL: portal.URL + "/signin",
+		UsageURL:  portal.URL + "/usage",
+		Accounts: []*eredes.Account{
+			{Username: "house", Password: "password", Cpes: []string{"PT0002000000000000XX"}},
+			{Username: "garage", Password: "password", Cpes: []string{"PT0002000000000000YY"}},
+		},
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+	}
+	plugin.SetParser(newParser(t))
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Len(t, acc.Errors, 1)
+
+	statuses := make(map[string]interface{})
+	for _, m := range acc.Metrics {
+		if m.Measurement == "eredes_status" {
+			statuses[m.Tags["cpe"]] = m.Fields["status"]
+		}
+	}
+	require.Equal(t, map[string]interface{}{
+		"PT0002000000000000XX": nil,
+		"PT0002000000000000YY": "password_expired",
+	}, statuses)
+}
+
+func TestSchemaHomeAssistant(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		CpeAliases:      map[string]string{"PT0002000000000000XX": "My House"},
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Schema:          "home_assistant",
+		Client:          &fakeDoer{body: usageResponse},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	var values []interface{}
+	for _, m := range acc.Metrics {
+		if m.Measurement == "eredes_status" {
+			continue
+		}
+		require.Equal(t, "kWh", m.Measurement)
+		require.Equal(t, "sensor", m.Tags["domain"])
+		require.Equal(t, "eredes_my_house", m.Tags["entity_id"])
+		require.Equal(t, "total_increasing", m.Fields["state_class_str"])
+		require.Equal(t, "energy", m.Fields["device_class_str"])
+		require.Equal(t, "kWh", m.Fields["unit_of_measurement_str"])
+		require.Equal(t, "My House", m.Fields["friendly_name_str"])
+		values = append(values, m.Fields["value"])
+	}
+	// The value is the running total of the consumption
+	require.Equal(t, []interface{}{0.125, 0.375}, values)
+}
+
+func TestPhaseFields(t *testing.T) {
+	body := strings.Replace(usageResponse, `"meterLoadCurve":"0.125"`,
+		`"meterLoadCurve":"0.125","meterLoadCurveL1":"0.025","meterLoadCurveL2":"0.050","meterLoadCurveL3":"0.050"`, 1)
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		Client:          &fakeDoer{body: body},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Equal(t, map[string]interface{}{"kwh": 0.125, "l1": 0.025, "l2": 0.05, "l3": 0.05}, acc.Metrics[0].Fields)
+	// A reading without the phases has none
+	require.Equal(t, map[string]interface{}{"kwh": 0.25}, acc.Metrics[1].Fields)
+}
+
+func TestFloatPrecision(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		FloatPrecision:  1,
+		Client:          &fakeDoer{body: usageResponse},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Equal(t, map[string]interface{}{"kwh": 0.1}, acc.Metrics[0].Fields)
+	require.Equal(t, map[string]interface{}{"kwh": 0.3}, acc.Metrics[1].Fields)
+}
+
+func TestEmitTimezoneLocal(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		// UTC+1 all year round
+		Timezone:      "Etc/GMT-1",
+		EmitTimezone:  "local",
+		Client:        &fakeDoer{body: usageResponse},
+		Authenticator: &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	// The wall clock time in the timezone, written as UTC
+	require.Equal(t, yesterday+"T13:15:00Z", acc.Metrics[0].Time.Format(time.RFC3339))
+	require.Equal(t, yesterday+"T13:30:00Z", acc.Metrics[1].Time.Format(time.RFC3339))
+}
+
+func TestSplitMeasurements(t *testing.T) {
+	plugin := &eredes.EREDES{
+		Cpe:               "PT0002000000000000XX",
+		HistoryInterval:   internal.Duration{Duration: 24 * time.Hour},
+		SplitMeasurements: true,
+		IncludeInjection:  true,
+		Client:            &fakeDoer{body: usageResponse},
+		Authenticator:     &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	measurements := make(map[string]string)
+	for _, m := range acc.Metrics {
+		if m.Measurement != "eredes_status" {
+			measurements[m.Tags["direction"]] = m.Measurement
+		}
+	}
+	require.Equal(t, map[string]string{
+		"consumption": "eredes_curve",
+		"injection":   "eredes_injection",
+	}, measurements)
+}
+
+// Answers the usage requests, recording their User-Agent
+func newUserAgentPortal(agents *[]string) *httptest.Server {
+	var lock sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		*agents = append(*agents, r.Header.Get("User-Agent"))
+		lock.Unlock()
+		fmt.Fprint(w, usageResponse)
+	}))
+}
+
+func TestUserAgent(t *testing.T) {
+	var agents []string
+	portal := newUserAgentPortal(&agents)
+	defer portal.Close()
+
+	plugin := &eredes.EREDES{
+		UsageURL:        portal.URL,
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		UserAgent:       "telegraf-eredes/1.0",
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	var acc testutil.Accumulator
+	require.NoError(t, plugin.Gather(&acc))
+	require.Empty(t, acc.Errors)
+
+	require.Equal(t, []string{"telegraf-eredes/1.0"}, agents)
+}
+
+func TestUserAgents(t *testing.T) {
+	var agents []string
+	portal := newUserAgentPortal(&agents)
+	defer portal.Close()
+
+	plugin := &eredes.EREDES{
+		UsageURL:        portal.URL,
+		Cpe:             "PT0002000000000000XX",
+		HistoryInterval: internal.Duration{Duration: 24 * time.Hour},
+		UserAgents:      []string{"agent-a", "agent-b"},
+		Authenticator:   &fakeAuthenticator{token: "TOKEN1234567890"},
+	}
+	require.NoError(t, plugin.Init())
+
+	for i := 0; i < 3; i++ {
+		var acc testutil.Accumulator
+		require.NoError(t, plugin.Gather(&acc))
+		require.Empty(t, acc.Errors)
+	}
+
+	// Each request takes the next one in turn
+	require.Equal(t, []string{"agent-a", "agent-b", "agent-a"}, agents)
+}
@@ -0,0 +1,160 @@
+package eredes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The portal requires the password to be changed, signing in again with the
+// same credentials is pointless
+var errPasswordExpired = errors.New("password expired, change it in the portal and update the configuration")
+
+// Markers of the password expired / must change responses
+var passwordExpiredMarkers = [][]byte{
+	[]byte("password expired"),
+	[]byte("passwordexpired"),
+	[]byte("password_expired"),
+	[]byte("must change"),
+	[]byte("mustchangepassword"),
+	[]byte("palavra-passe expirada"),
+	[]byte("alterar a palavra-passe"),
+}
+
+func isPasswordExpired(body []byte) bool {
+	body = bytes.ToLower(body)
+	for _, marker := range passwordExpiredMarkers {
+		if bytes.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Response with an unexpected status code
+type statusError struct {
+	statusCode         int
+	successStatusCodes []int
+	body               []byte
+}
+
+func (e *statusError) Error() string {
+	msg := fmt.Sprintf("received status code %d (%s), expected any value out of %v",
+		e.statusCode,
+		http.StatusText(e.statusCode),
+		e.successStatusCodes)
+	if snippet := bodySnippet(e.body); snippet != "" {
+		msg += fmt.Sprintf(", response: %q", snippet)
+	}
+	return msg
+}
+
+// Successful response that isn't JSON, usually the maintenance page or a
+// redirect to the login page
+type contentTypeError struct {
+	contentType string
+	body        []byte
+}
+
+func (e *contentTypeError) Error() string {
+	return fmt.Sprintf("non-JSON response (likely maintenance or auth redirect): content type %q, response: %q", e.contentType, bodySnippet(e.body))
+}
+
+// Checks a response is JSON before it's parsed. A JSON body is accepted
+// whatever its content type, and a missing content type isn't checked.
+func checkContentType(contentType string, body []byte) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return nil
+	}
+	return &contentTypeError{contentType: contentType, body: body}
+}
+
+// Bytes of the response body shown in errors
+const snippetSize = 256
+
+// Values of the token and credential keys of a JSON body, of form and
+// query key=value pairs, of HTML inputs and bearer tokens
+var (
+	secretValue  = regexp.MustCompile(`(?i)("[^"]*(token|password|secret|authorization|cookie|session)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	secretPair   = regexp.MustCompile(`(?i)([\w.\-]*(token|password|secret|authorization|cookie|session)[\w.\-]*=)[^&\s"'<>]+`)
+	secretInput  = regexp.MustCompile(`(?i)(name=["'][^"']*(token|password|secret|session)[^"']*["'][^>]*?value=)(?:"[^"]*"|'[^']*')`)
+	bearerSecret = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]+=*`)
+)
+
+// Start of a response body for an error message, with the secrets
+// redacted, so the portal's own error message shows in the logs
+func bodySnippet(body []byte) string {
+	snippet := secretValue.ReplaceAllString(string(body), `${1}"[redacted]"`)
+	snippet = secretPair.ReplaceAllString(snippet, "${1}[redacted]")
+	snippet = secretInput.ReplaceAllString(snippet, `${1}"[redacted]"`)
+	snippet = bearerSecret.ReplaceAllString(snippet, "${1}[redacted]")
+	snippet = strings.Join(strings.Fields(snippet), " ")
+	if len(snippet) > snippetSize {
+		// Not in the middle of a character
+		end := snippetSize
+		for end > 0 && !utf8.RuneStart(snippet[end]) {
+			end--
+		}
+		snippet = snippet[:end] + "..."
+	}
+	return snippet
+}
+
+// Error of a failed request with the context needed to tell which account,
+// supply point and date range failed
+type requestError struct {
+	account  string
+	cpe      string
+	name     string
+	start    time.Time
+	end      time.Time
+	endpoint string
+	attempt  int
+	err      error
+}
+
+func (e *requestError) Error() string {
+	msg := fmt.Sprintf("cpe=%q", e.cpe)
+	if e.name != "" {
+		msg += fmt.Sprintf(" name=%q", e.name)
+	}
+	if e.account != "" {
+		msg = fmt.Sprintf("account=%q ", e.account) + msg
+	}
+	if !e.start.IsZero() {
+		msg += fmt.Sprintf(" window=%q", e.start.Format("2006-01-02 15:04:05")+" - "+e.end.Format("2006-01-02 15:04:05"))
+	}
+	return msg + fmt.Sprintf(" endpoint=%q attempt=%d: %s", e.endpoint, e.attempt, e.err)
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// Error of a request of a CPE besides the usages, prefixed with the
+// operation (ex: gatherDaily)
+func (eredes *EREDES) cpeError(s *session, cpe string, op string, endpoint string, err error) error {
+	return fmt.Errorf("[%s]: %w", op, &requestError{
+		account:  s.name,
+		cpe:      cpe,
+		name:     eredes.CpeAliases[cpe],
+		endpoint: endpoint,
+		attempt:  1,
+		err:      err,
+	})
+}
@@ -0,0 +1,90 @@
+package eredes
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Estimates older than this are given up on, so a meter that never reports
+// real readings doesn't hold the watermark back forever
+const estimatedRetryWindow = 7 * 24 * time.Hour
+
+// Earliest estimated reading dropped per CPE in the current cycle, the
+// watermark is held back to it so the period is requested again
+type estimates struct {
+	sync.Mutex
+	earliest map[string]time.Time
+}
+
+// Count an estimated reading that was dropped
+func (e *estimates) dropped(cpe string, t time.Time) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.earliest == nil {
+		e.earliest = make(map[string]time.Time)
+	}
+	if earliest, ok := e.earliest[cpe]; !ok || t.Before(earliest) {
+		e.earliest[cpe] = t
+	}
+}
+
+// Returns and clears the earliest estimated reading dropped of a CPE, if
+// it's still worth requesting again. Windows are gathered in order and stop
+// at the first one held back, so it's always in the last window gathered.
+func (e *estimates) take(cpe string) (time.Time, bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	earliest, ok := e.earliest[cpe]
+	if !ok {
+		return time.Time{}, false
+	}
+	delete(e.earliest, cpe)
+	if time.Since(earliest) > estimatedRetryWindow {
+		return time.Time{}, false
+	}
+	return earliest, true
+}
+
+// Whether a reading is at or after the earliest estimated reading dropped
+// of a CPE in the current cycle, that the watermark will be held back to
+func (e *estimates) heldBack(cpe string, t time.Time) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	earliest, ok := e.earliest[cpe]
+	return ok && !t.Before(earliest) && time.Since(earliest) <= estimatedRetryWindow
+}
+
+// Forget the estimated readings of a previous cycle
+func (e *estimates) reset(cpe string) {
+	e.Lock()
+	defer e.Unlock()
+
+	delete(e.earliest, cpe)
+}
+
+// Skip an estimated reading if drop_estimated is set
+func (eredes *EREDES) dropEstimated(cpe string, quality string, t time.Time) bool {
+	if !eredes.DropEstimated || quality != "estimated" {
+		return false
+	}
+	eredes.estimates.dropped(cpe, t)
+	return true
+}
+
+// Watermark after a window, held back before the earliest estimated
+// reading dropped so it's requested again once real data replaces it. The
+// readings emitted after it aren't committed either, so the real ones are
+// emitted even with skip_emitted.
+func (eredes *EREDES) windowWatermark(cpe string, end time.Time) (time.Time, bool) {
+	earliest, ok := eredes.estimates.take(cpe)
+	if !ok {
+		return end, false
+	}
+
+	log.Printf("[eredes] %s estimated readings dropped since %s, requesting them again next cycles", cpe, earliest.Format("2006-01-02 15:04:05"))
+	return earliest.Add(-time.Second), true
+}
@@ -0,0 +1,124 @@
+package eredes
+
+import (
+	"math"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Remove the fields of the parsed readings not passing fieldinclude and
+// fieldexclude, before the readings are built from their numeric fields.
+// The quality_key, source_key and phase_keys fields are always kept.
+func (eredes *EREDES) filterFields(metrics []telegraf.Metric) {
+	if eredes.fieldFilter == nil {
+		return
+	}
+
+	for _, metric := range metrics {
+		var removed []string
+		for _, field := range metric.FieldList() {
+			if !eredes.bookkeepingKey(field.Key) && !eredes.fieldFilter.Match(field.Key) {
+				removed = append(removed, field.Key)
+			}
+		}
+		for _, key := range removed {
+			metric.RemoveField(key)
+		}
+	}
+}
+
+// Rename the fields of an emitted reading with field_rename
+func (eredes *EREDES) renameFields(fields map[string]interface{}) {
+	for from, to := range eredes.FieldRename {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+}
+
+// Convert the numeric fields of the parsed readings from Wh to kWh with
+// unit = "kwh", named with a _kwh suffix. Fields already in kWh (ex: the
+// load curve) are left as they are. Done after the post
+// processors, so their fields and thresholds stay in the portal unit.
+func (eredes *EREDES) convertUnits(metrics []telegraf.Metric) {
+	if eredes.Unit != "kwh" {
+		return
+	}
+
+	for _, metric := range metrics {
+		converted := make(map[string]float64)
+		for _, field := range metric.FieldList() {
+			if eredes.bookkeepingKey(field.Key) || kwhField(field.Key) {
+				continue
+			}
+			if wh, ok := toFloat(field.Value); ok {
+				converted[field.Key] = wh / 1000
+			}
+		}
+		for key, kwh := range converted {
+			metric.RemoveField(key)
+			metric.AddField(kwhFieldName(key), kwh)
+		}
+	}
+}
+
+// Fields in kWh as parsed: the load curve of the portal, kwh of the
+// built-in parser and transform_command, and _kwh ones
+func kwhField(key string) bool {
+	return key == "kwh" || key == "meterLoadCurve" || strings.HasSuffix(key, "_kwh")
+}
+
+// Field of the readings with the consumption, after unit
+func (eredes *EREDES) consumptionField() string {
+	if eredes.Unit == "kwh" && !kwhField(eredes.ConsumptionField) {
+		return kwhFieldName(eredes.ConsumptionField)
+	}
+	return eredes.ConsumptionField
+}
+
+// Name of a field in kWh, ex: a_plus_wh and a_plus become a_plus_kwh
+func kwhFieldName(key string) string {
+	if key == "wh" {
+		return "kwh"
+	}
+	return strings.TrimSuffix(key, "_wh") + "_kwh"
+}
+
+// Force the type of the emitted fields with field_types, so a value the
+// portal sends as "123" one day and "123.0" the next stays one type. Float
+// fields are then rounded to float_precision decimals.
+func (eredes *EREDES) convertTypes(fields map[string]interface{}) {
+
+	for key, fieldType := range eredes.FieldTypes {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+		v, ok := toFloat(value)
+		if !ok {
+			continue
+		}
+		switch fieldType {
+		case "float":
+			fields[key] = v
+		case "int":
+			fields[key] = int64(math.Round(v))
+		}
+	}
+	eredes.roundFloats(fields)
+}
+
+func (eredes *EREDES) roundFloats(fields map[string]interface{}) {
+	if eredes.FloatPrecision <= 0 {
+		return
+	}
+
+	scale := math.Pow(10, float64(eredes.FloatPrecision))
+	for key, value := range fields {
+		if v, ok := value.(float64); ok {
+			fields[key] = math.Round(v*scale) / scale
+		}
+	}
+}
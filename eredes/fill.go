@@ -0,0 +1,91 @@
+package eredes
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Series of an emitted reading, its measurement before the schema and its
+// tags, so the points filled next to it land in the same series
+type readingSeries struct {
+	time time.Time
+	name string
+	tags map[string]string
+}
+
+// Emit a point for each period missing from the readings of a window, so
+// charts don't interpolate across the holes. The grid of the periods goes
+// from the start of the window (or the newest reading already emitted) to
+// the end of the last day with readings, days not published yet aren't
+// filled. The points have a missing field, and a zero kwh with
+// fill_missing = "zero"; line protocol has no null, so with "null" the kwh
+// field is just absent. They get the measurement and tags of the reading
+// before them, or after them before the first one.
+func (eredes *EREDES) fillMissing(acc telegraf.Accumulator, cpe string, direction string, series []readingSeries, after time.Time, end time.Time) {
+	resolution := eredes.readingResolution()
+	if eredes.FillMissing == "" || eredes.FillMissing == "none" || resolution == 0 || len(series) == 0 {
+		return
+	}
+
+	sort.SliceStable(series, func(i, j int) bool { return series[i].time.Before(series[j].time) })
+	have := make(map[int64]bool, len(series))
+	for _, s := range series {
+		have[s.time.UnixNano()] = true
+	}
+
+	// Periods before the first reading, on the same grid
+	back := func(t time.Time) time.Time {
+		if resolution%(24*time.Hour) == 0 {
+			return t.AddDate(0, 0, -int(resolution/(24*time.Hour)))
+		}
+		return t.Add(-resolution)
+	}
+	start := series[0].time
+	for t := back(start); t.After(after); t = back(t) {
+		start = t
+	}
+
+	last := series[len(series)-1].time.In(eredes.location)
+	lastDayEnd := time.Date(last.Year(), last.Month(), last.Day()+1, 0, 0, 0, 0, eredes.location)
+
+	filled := 0
+	i := 0
+	for t := start; t.Before(lastDayEnd) && !t.After(end); t = addCalendar(t, resolution) {
+		for i+1 < len(series) && !series[i+1].time.After(t) {
+			i++
+		}
+		if have[t.UnixNano()] {
+			continue
+		}
+
+		tags := copyTags(series[i].tags)
+		delete(tags, "tariff_period")
+		eredes.tagTariffPeriod(tags, cpe, t)
+
+		fields := map[string]interface{}{"missing": true}
+		if eredes.FillMissing == "zero" {
+			fields["kwh"] = 0.0
+		}
+		eredes.renameFields(fields)
+		eredes.convertTypes(fields)
+		if name, ok := eredes.applySchema(eredes.measurement(cpe, series[i].name, direction), tags, fields); ok {
+			acc.AddFields(name, fields, tags, t)
+			filled++
+		}
+	}
+
+	if filled > 0 {
+		log.Printf("[eredes] %s filled %d missing readings", cpe, filled)
+	}
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,90 @@
+package eredes
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Readings per day of the CPEs in final_harvest, counted during a cycle to
+// report the completeness of their history
+type harvests struct {
+	sync.Mutex
+	points map[string]map[string]int
+}
+
+// Tells if the CPE is flagged for final_harvest
+func (eredes *EREDES) harvesting(cpe string) bool {
+	o, ok := eredes.overrides[cpe]
+	return ok && o.FinalHarvest
+}
+
+func (eredes *EREDES) startHarvest(cpe string) {
+	eredes.harvests.Lock()
+	defer eredes.harvests.Unlock()
+
+	if eredes.harvests.points == nil {
+		eredes.harvests.points = make(map[string]map[string]int)
+	}
+	eredes.harvests.points[cpe] = make(map[string]int)
+}
+
+// Count a reading of a CPE in final_harvest
+func (eredes *EREDES) recordHarvest(r Reading) {
+	eredes.harvests.Lock()
+	defer eredes.harvests.Unlock()
+
+	if points, ok := eredes.harvests.points[r.Cpe]; ok {
+		points[r.Time.Format("2006-01-02")]++
+	}
+}
+
+// Report the completeness of the history of a CPE in final_harvest, as the
+// eredes_harvest metric and in the log. Days are complete with a reading
+// per period of the reading_type; monthly readings are only counted.
+func (eredes *EREDES) reportHarvest(acc telegraf.Accumulator, cpe string, start time.Time, end time.Time, requestErr error) {
+	eredes.harvests.Lock()
+	points := eredes.harvests.points[cpe]
+	delete(eredes.harvests.points, cpe)
+	eredes.harvests.Unlock()
+
+	expected := 0
+	if resolution := eredes.readingResolution(); resolution > 0 {
+		expected = int(24 * time.Hour / resolution)
+	}
+
+	days, completeDays, missing := 0, 0, 0
+	var firstMissing string
+	for day := start.Add(time.Second); !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		days++
+		if points[date] >= expected {
+			completeDays++
+			continue
+		}
+		missing += expected - points[date]
+		if firstMissing == "" {
+			firstMissing = date
+		}
+	}
+
+	complete := requestErr == nil && completeDays == days
+	fields := map[string]interface{}{
+		"days":           days,
+		"complete_days":  completeDays,
+		"missing_points": missing,
+		"complete":       complete,
+	}
+	if firstMissing != "" {
+		fields["first_incomplete_day"] = firstMissing
+	}
+	acc.AddFields("eredes_harvest", fields, eredes.cpeTags(cpe))
+
+	if complete {
+		log.Printf("[eredes] final harvest of %s complete: %d days from %s to %s", cpe, days, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	} else {
+		log.Printf("[eredes] final harvest of %s incomplete: %d of %d days complete, %d readings missing, first incomplete day %s", cpe, completeDays, days, missing, firstMissing)
+	}
+}
@@ -0,0 +1,173 @@
+package eredes
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// HealthToken grants access to the health endpoint, limited to the data of
+// some supply points (ex: a tenant's own CPE) or to all if none are set
+type HealthToken struct {
+	Token string   `toml:"token"`
+	Cpes  []string `toml:"cpes"`
+}
+
+// Response of the health endpoint
+type healthResponse struct {
+	Snapshot
+	Healthy    bool    `json:"healthy"`
+	LagSeconds float64 `json:"lag_seconds"`
+
+	// Earliest time the next cycle requests the portal
+	NextGather time.Time `json:"next_gather"`
+}
+
+// Start the health endpoint, if configured
+func (eredes *EREDES) Start(_ telegraf.Accumulator) error {
+	if eredes.HealthAddress == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", eredes.HealthAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", eredes.serveHealth)
+	eredes.healthServer = &http.Server{Handler: mux}
+
+	go func() {
+		if err := eredes.healthServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[eredes] health endpoint error: %s", err)
+		}
+	}()
+
+	log.Printf("[eredes] health endpoint listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop the health endpoint and save the state and cookies, Telegraf calls
+// it on SIGTERM (ex: docker stop)
+func (eredes *EREDES) Stop() {
+	if eredes.healthServer != nil {
+		eredes.healthServer.Close()
+	}
+
+	if err := eredes.state.save(eredes.StateFile); err != nil {
+		log.Printf("[eredes] error saving state: %s", err)
+	}
+	if err := eredes.saveCookies(); err != nil {
+		log.Printf("[eredes] error saving cookies: %s", err)
+	}
+}
+
+// Reports the plugin state, with status 503 when it isn't healthy so it
+// can be used as is by Docker/Kubernetes health checks. With the cpe query
+// parameter, only the state of that supply point.
+func (eredes *EREDES) serveHealth(w http.ResponseWriter, r *http.Request) {
+	snapshot := eredes.Snapshot()
+
+	var token *HealthToken
+	if len(eredes.HealthTokens) > 0 {
+		token = eredes.healthToken(r)
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if len(token.Cpes) > 0 {
+			snapshot = snapshot.scoped(token.Cpes)
+		}
+	}
+	if cpe := r.URL.Query().Get("cpe"); cpe != "" {
+		if token != nil && len(token.Cpes) > 0 && !contains(token.Cpes, cpe) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		snapshot = snapshot.scoped([]string{cpe})
+	}
+	response := healthResponse{
+		Snapshot:   snapshot,
+		Healthy:    snapshot.Healthy(),
+		LagSeconds: snapshot.Lag.Seconds(),
+	}
+	if !snapshot.LastGather.IsZero() {
+		response.NextGather = snapshot.LastGather.Add(eredes.MinEffectiveInterval.Duration)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("[eredes] error writing health response: %s", err)
+	}
+}
+
+// Returns the health token of the request bearer, nil if there's none. The
+// hashes are compared in constant time, so neither the token nor its length
+// can be guessed from the response time.
+func (eredes *EREDES) healthToken(r *http.Request) *HealthToken {
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return nil
+	}
+	bearer := sha256.Sum256([]byte(strings.TrimSpace(auth[len("Bearer "):])))
+
+	var match *HealthToken
+	for _, token := range eredes.HealthTokens {
+		sum := sha256.Sum256([]byte(token.Token))
+		if subtle.ConstantTimeCompare(bearer[:], sum[:]) == 1 && match == nil {
+			match = token
+		}
+	}
+	return match
+}
+
+// Only the data of the given CPEs. The last success, error and reading are
+// the ones of these supply points, so the health only depends on them. The
+// plugin state, the details of the accounts and the counters may be about
+// other supply points, so they're left out.
+func (s Snapshot) scoped(cpes []string) Snapshot {
+	scoped := Snapshot{Cpes: make(map[string]CpeStatus)}
+	for _, total := range s.DailyTotals {
+		if contains(cpes, total.Cpe) {
+			scoped.DailyTotals = append(scoped.DailyTotals, total)
+		}
+	}
+
+	// The least up to date supply point tells the health
+	sorted := append([]string(nil), cpes...)
+	sort.Strings(sorted)
+	for _, cpe := range sorted {
+		status, ok := s.Cpes[cpe]
+		if !ok {
+			continue
+		}
+		first := len(scoped.Cpes) == 0
+		scoped.Cpes[cpe] = status
+		if first || status.LastSuccess.Before(scoped.LastSuccess) {
+			scoped.LastSuccess = status.LastSuccess
+		}
+		if first || status.LastReading.Before(scoped.LastReading) {
+			scoped.LastReading = status.LastReading
+		}
+		if scoped.LastError == "" && status.LastError != "" {
+			scoped.LastError = cpe + ": " + status.LastError
+		}
+	}
+	if !scoped.LastReading.IsZero() {
+		scoped.Lag = time.Since(scoped.LastReading)
+	}
+	return scoped
+}
@@ -0,0 +1,66 @@
+package eredes
+
+import "time"
+
+// Fixed national holidays of Portugal, as month and day
+var fixedHolidays = []struct {
+	month time.Month
+	day   int
+	// Suspended from 2013 to 2015
+	suspended bool
+}{
+	{time.January, 1, false},
+	{time.April, 25, false},
+	{time.May, 1, false},
+	{time.June, 10, false},
+	{time.August, 15, false},
+	{time.October, 5, true},
+	{time.November, 1, true},
+	{time.December, 1, true},
+	{time.December, 8, false},
+	{time.December, 25, false},
+}
+
+// Tells if a day in Portugal is a national holiday, the weekly tariff cycle
+// treats them as Sundays
+func holiday(t time.Time) bool {
+	t = t.In(lisbon)
+	year, month, day := t.Date()
+	suspended := year >= 2013 && year <= 2015
+
+	for _, h := range fixedHolidays {
+		if h.month == month && h.day == day && !(h.suspended && suspended) {
+			return true
+		}
+	}
+
+	// Good Friday, Easter and Corpus Christi
+	easter := easterSunday(year)
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	switch date.Sub(easter) / (24 * time.Hour) {
+	case -2, 0:
+		return true
+	case 60:
+		return !suspended
+	}
+	return false
+}
+
+// Easter Sunday of a year, with the anonymous Gregorian algorithm
+func easterSunday(year int) time.Time {
+	a := year % 19
+	b := year / 100
+	c := year % 100
+	d := b / 4
+	e := b % 4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i := c / 4
+	k := c % 4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
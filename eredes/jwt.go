@@ -0,0 +1,64 @@
+package eredes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Time before the token expiry when a new one is requested
+const reauthMargin = 5 * time.Minute
+
+// TokenInfo is what can be told about the current token, when it's a JWT
+type TokenInfo struct {
+	Expires  time.Time `json:"expires"`
+	Scopes   []string  `json:"scopes,omitempty"`
+	ReauthAt time.Time `json:"reauth_at"`
+}
+
+// Decode the claims of a JWT, without verifying it, only to know when it
+// expires. Returns false if the token isn't a JWT.
+func parseJWT(token string) (TokenInfo, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenInfo{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return TokenInfo{}, false
+	}
+
+	var claims struct {
+		Exp    float64     `json:"exp"`
+		Scope  string      `json:"scope"`
+		Scopes interface{} `json:"scopes"`
+		Scp    interface{} `json:"scp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return TokenInfo{}, false
+	}
+
+	info := TokenInfo{
+		Expires: time.Unix(int64(claims.Exp), 0),
+	}
+	info.ReauthAt = info.Expires.Add(-reauthMargin)
+
+	// Scopes come as a space separated string or a list, depending on the issuer
+	info.Scopes = strings.Fields(claims.Scope)
+	for _, scopes := range []interface{}{claims.Scopes, claims.Scp} {
+		switch v := scopes.(type) {
+		case string:
+			info.Scopes = append(info.Scopes, strings.Fields(v)...)
+		case []interface{}:
+			for _, scope := range v {
+				if s, ok := scope.(string); ok {
+					info.Scopes = append(info.Scopes, s)
+				}
+			}
+		}
+	}
+
+	return info, true
+}
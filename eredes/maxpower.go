@@ -0,0 +1,62 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/tidwall/gjson"
+)
+
+// Request the maximum quarter-hour power (potência tomada) per day of the
+// CPE range and emit it as eredes_maxpower, with a max_power_kw field, at
+// the time of the peak if the portal reports it. Fetched once a day.
+func (eredes *EREDES) gatherMaxPower(acc telegraf.Accumulator, s *session, token string, cpe string) error {
+	startDate, endDate := eredes.requestWindow(cpe)
+	start := startDate.Format("2006-01-02 15:04:05")
+	end := endDate.Format("2006-01-02 15:04:05")
+
+	body := `{"cpe": "` + cpe + `","start_date":"` + start + `","end_date":"` + end + `"}`
+
+	log.Printf("[eredes] requesting max power of %s", cpe)
+	response, err := s.makeRequest(eredes.maxPowerURL(), body, token)
+	if err != nil {
+		return err
+	}
+
+	days := gjson.GetBytes(response, eredes.MaxPowerPath)
+	if !days.Exists() {
+		return fmt.Errorf("no max power in %q", eredes.MaxPowerPath)
+	}
+
+	added := 0
+	for _, day := range days.Array() {
+		value := day.Get("maxPower")
+		if !value.Exists() {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", day.Get("timestamp").String(), eredes.location)
+		if err != nil {
+			t, err = time.ParseInLocation("2006-01-02", day.Get("date").String(), eredes.location)
+			if err != nil {
+				return fmt.Errorf("invalid max power date: %s", err)
+			}
+		}
+
+		acc.AddFields(eredes.measurement(cpe, "eredes_maxpower", ""), map[string]interface{}{"max_power_kw": value.Float()}, eredes.cpeTags(cpe), t)
+		added++
+	}
+
+	log.Printf("[eredes] added %d max power readings of %s", added, cpe)
+	s.maxPowerFetched.done(cpe)
+	return nil
+}
+
+func (eredes *EREDES) maxPowerURL() string {
+	if eredes.MaxPowerURL == "" {
+		return eredesMaxPower
+	}
+	return eredes.MaxPowerURL
+}
@@ -0,0 +1,118 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Meter installed at a supply point, added to its readings so the series
+// can be told apart when the meter is replaced
+type meter struct {
+	serial string
+	brand  string
+	model  string
+
+	fetchedAt time.Time
+}
+
+// Meters of the session CPEs, refreshed daily
+type meters struct {
+	sync.Mutex
+	byCpe map[string]*meter
+}
+
+// Tells if the meter of a CPE has to be fetched
+func (s *session) meterDue(cpe string) bool {
+	m := s.cachedMeter(cpe)
+	return m == nil || time.Since(m.fetchedAt) >= 24*time.Hour
+}
+
+// Returns the last meter fetched of a CPE, nil if none
+func (s *session) cachedMeter(cpe string) *meter {
+	s.meters.Lock()
+	defer s.meters.Unlock()
+
+	return s.meters.byCpe[cpe]
+}
+
+// Returns the meter of a CPE, fetched again if older than a day. On error
+// the previous one is kept, if any.
+func (s *session) meter(cpe string, token string) (*meter, error) {
+	m := s.cachedMeter(cpe)
+	if !s.meterDue(cpe) {
+		return m, nil
+	}
+
+	fetched, err := s.fetchMeter(cpe, token)
+	if err != nil {
+		return m, err
+	}
+
+	s.meters.Lock()
+	defer s.meters.Unlock()
+	if s.meters.byCpe == nil {
+		s.meters.byCpe = make(map[string]*meter)
+	}
+	s.meters.byCpe[cpe] = fetched
+	return fetched, nil
+}
+
+func (s *session) fetchMeter(cpe string, token string) (*meter, error) {
+	log.Printf("[eredes] fetching meter of %s", cpe)
+	response, err := s.makeRequest(s.eredes.meterURL(), `{"cpe": "`+cpe+`"}`, token)
+	if err != nil {
+		return nil, err
+	}
+
+	result := gjson.GetBytes(response, "Body.Result")
+	if !result.Exists() {
+		return nil, fmt.Errorf("no meter in response")
+	}
+
+	return &meter{
+		serial:    result.Get("serialNumber").String(),
+		brand:     result.Get("brand").String(),
+		model:     result.Get("model").String(),
+		fetchedAt: time.Now(),
+	}, nil
+}
+
+// Add the meter details to the tags of a reading
+func (m *meter) apply(tags map[string]string) {
+	if m.serial != "" {
+		tags["meter_serial"] = m.serial
+	}
+	if m.brand != "" {
+		tags["meter_brand"] = m.brand
+	}
+	if m.model != "" {
+		tags["meter_model"] = m.model
+	}
+}
+
+func (eredes *EREDES) meterURL() string {
+	if eredes.MeterURL == "" {
+		return eredesMeter
+	}
+	return eredes.MeterURL
+}
+
+// Contract and meter of a supply point added to its readings, nil if not
+// enabled or not fetched yet
+type metadata struct {
+	contract *contract
+	meter    *meter
+}
+
+func (m metadata) apply(tags map[string]string, fields map[string]interface{}) {
+	if m.contract != nil {
+		m.contract.apply(tags, fields)
+	}
+	if m.meter != nil {
+		m.meter.apply(tags)
+	}
+}
@@ -0,0 +1,85 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/tidwall/gjson"
+)
+
+// Months of billing readings requested, the portal corrects the last ones
+const monthlyReadingsMonths = 13
+
+// Last time a daily request type was fetched per CPE
+type fetchTimes struct {
+	sync.Mutex
+	at map[string]time.Time
+}
+
+func (f *fetchTimes) due(cpe string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	return time.Since(f.at[cpe]) >= 24*time.Hour
+}
+
+func (f *fetchTimes) done(cpe string) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.at == nil {
+		f.at = make(map[string]time.Time)
+	}
+	f.at[cpe] = time.Now()
+}
+
+// Request the billing cycle readings (leituras) of the last months and emit
+// one eredes_monthly point per cycle, at its end, with the cycle start and
+// end as tags. Fetched once a day.
+func (eredes *EREDES) gatherMonthly(acc telegraf.Accumulator, s *session, token string, cpe string) error {
+	end := time.Now().In(eredes.location)
+	start := end.AddDate(0, -monthlyReadingsMonths, 0)
+
+	body := `{"cpe": "` + cpe + `","start_date":"` + start.Format("2006-01-02") + `","end_date":"` + end.Format("2006-01-02") + `"}`
+
+	log.Printf("[eredes] requesting monthly readings of %s", cpe)
+	response, err := s.makeRequest(eredes.monthlyReadingsURL(), body, token)
+	if err != nil {
+		return err
+	}
+
+	readings := gjson.GetBytes(response, eredes.MonthlyReadingsPath)
+	if !readings.Exists() {
+		return fmt.Errorf("no monthly readings in %q", eredes.MonthlyReadingsPath)
+	}
+
+	added := 0
+	for _, reading := range readings.Array() {
+		periodStart := reading.Get("startDate").String()
+		periodEnd := reading.Get("endDate").String()
+		t, err := time.ParseInLocation("2006-01-02", periodEnd, eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid monthly reading end date: %s", err)
+		}
+
+		tags := eredes.cpeTags(cpe)
+		tags["period_start"] = periodStart
+		tags["period_end"] = periodEnd
+		acc.AddFields("eredes_monthly", map[string]interface{}{"kwh": reading.Get("consumption").Float()}, tags, t)
+		added++
+	}
+	s.monthlyFetched.done(cpe)
+
+	log.Printf("[eredes] added %d monthly readings of %s", added, cpe)
+	return nil
+}
+
+func (eredes *EREDES) monthlyReadingsURL() string {
+	if eredes.MonthlyReadingsURL == "" {
+		return eredesMonthlyReadings
+	}
+	return eredes.MonthlyReadingsURL
+}
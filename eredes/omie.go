@@ -0,0 +1,242 @@
+package eredes
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Marginal price file of the Portuguese zone of the day-ahead market,
+// {date} is replaced by the day as YYYYMMDD
+const omiePrices = "https://www.omie.es/es/file-download?parents%5B0%5D=marginalpdbcpt&filename=marginalpdbcpt_{date}.1"
+
+// Days of prices kept, readings older than this are priced again
+const omieCacheDays = 60
+
+// Time before the prices of a day that failed to download are requested
+// again, so a day not published yet isn't requested for every window
+const omieRetryInterval = time.Hour
+
+// OMIE joins the consumption with the OMIE day-ahead prices, for indexed
+// tariffs. The cost of a kWh is price / 1000 * factor + margin.
+type OMIE struct {
+	URL string `toml:"url"`
+
+	// Multiplier of the price (ex: losses) and €/kWh added to it
+	Factor float64 `toml:"factor"`
+	Margin float64 `toml:"margin"`
+
+	client *http.Client
+
+	sync.Mutex
+	// Prices per day (YYYYMMDD), per period of the day
+	days map[string][]float64
+	// Last failed download per day (YYYYMMDD), with its error
+	failures map[string]omieFailure
+}
+
+type omieFailure struct {
+	at  time.Time
+	err error
+}
+
+// Prices are published in Spanish time
+var madrid = mustLoadLocation("Europe/Madrid")
+
+// The prices are downloaded through the transport of the portal requests
+// (proxy, dialer and TLS settings)
+func (o *OMIE) init(transport http.RoundTripper, timeout time.Duration) {
+	if o.URL == "" {
+		o.URL = omiePrices
+	}
+	if o.Factor == 0 {
+		o.Factor = 1
+	}
+	o.client = &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// Day of the market of a time, prices are published per Spanish day
+func omieDay(t time.Time) time.Time {
+	t = t.In(madrid)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, madrid)
+}
+
+// Price in €/MWh of the market period of a time, with the start of the
+// period. Hourly periods until the market moved to quarter hours. Periods
+// are counted from midnight, so days changing time have 23 or 25 hours.
+func omiePeriod(prices []float64, day time.Time, t time.Time) (float64, time.Time, error) {
+	resolution := time.Hour
+	if len(prices) > 25 {
+		resolution = 15 * time.Minute
+	}
+	period := int(t.Sub(day) / resolution)
+	if period < 0 || period >= len(prices) {
+		return 0, time.Time{}, fmt.Errorf("no OMIE price for %s", t.Format(time.RFC3339))
+	}
+	return prices[period], day.Add(time.Duration(period) * resolution), nil
+}
+
+// Prices of a day, downloaded once. A failed download isn't requested
+// again before omieRetryInterval.
+func (o *OMIE) dayPrices(day time.Time) ([]float64, error) {
+	date := day.Format("20060102")
+
+	o.Lock()
+	defer o.Unlock()
+	if prices, ok := o.days[date]; ok {
+		return prices, nil
+	}
+	if failure, ok := o.failures[date]; ok && time.Since(failure.at) < omieRetryInterval {
+		return nil, failure.err
+	}
+
+	prices, err := o.download(date)
+	if err != nil {
+		if o.failures == nil {
+			o.failures = make(map[string]omieFailure)
+		}
+		o.failures[date] = omieFailure{at: time.Now(), err: err}
+		return nil, err
+	}
+	delete(o.failures, date)
+
+	if o.days == nil {
+		o.days = make(map[string][]float64)
+	}
+	o.days[date] = prices
+	oldest := time.Now().AddDate(0, 0, -omieCacheDays).Format("20060102")
+	for d := range o.days {
+		if d < oldest {
+			delete(o.days, d)
+		}
+	}
+	return prices, nil
+}
+
+func (o *OMIE) download(date string) ([]float64, error) {
+	log.Printf("[eredes] downloading OMIE prices of %s", date)
+	resp, err := o.client.Get(strings.Replace(o.URL, "{date}", date, 1))
+	if err != nil {
+		return nil, fmt.Errorf("OMIE prices of %s: %s", date, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("OMIE prices of %s: %s", date, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OMIE prices of %s: received status code %d (%s)", date, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	prices, err := parseOMIEPrices(b)
+	if err != nil {
+		return nil, fmt.Errorf("OMIE prices of %s: %s", date, err)
+	}
+	return prices, nil
+}
+
+// Parse a marginal price file. Lines are year;month;day;period;price;...
+// with the Portuguese price last, between a header and a * line.
+func parseOMIEPrices(b []byte) ([]float64, error) {
+	var prices []float64
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		values := strings.Split(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"), ";")
+		if len(values) < 5 {
+			continue
+		}
+		period, err := strconv.Atoi(values[3])
+		if err != nil {
+			continue
+		}
+		price, err := strconv.ParseFloat(strings.Replace(values[len(values)-1], ",", ".", 1), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid price of period %d", period)
+		}
+		if period != len(prices)+1 {
+			return nil, fmt.Errorf("unexpected period %d", period)
+		}
+		prices = append(prices, price)
+	}
+	if len(prices) == 0 {
+		return nil, fmt.Errorf("no prices")
+	}
+	return prices, scanner.Err()
+}
+
+// Consumption and cost of a market period
+type omiePeriodCost struct {
+	kwh   float64
+	cost  float64
+	price float64
+}
+
+// Emit the cost of the quarter-hour consumption readings per market period
+// as eredes_omie: per hour while the market had hourly prices, per quarter
+// hour since. A day without prices yet is skipped until the next cycle.
+func (eredes *EREDES) addOMIECosts(acc telegraf.Accumulator, cpe string, readings []Reading) {
+	if eredes.OMIE == nil || eredes.ReadingType != "quarter_hourly" {
+		return
+	}
+
+	// Prices of each day of the readings, requested once per day
+	prices := make(map[time.Time][]float64)
+	failed := make(map[time.Time]bool)
+	periods := make(map[time.Time]*omiePeriodCost)
+	for _, r := range readings {
+		if r.Direction != "" && r.Direction != "consumption" {
+			continue
+		}
+
+		day := omieDay(r.Time)
+		if failed[day] {
+			continue
+		}
+		if prices[day] == nil {
+			p, err := eredes.OMIE.dayPrices(day)
+			if err != nil {
+				failed[day] = true
+				acc.AddError(fmt.Errorf("[omie]: %s", err))
+				continue
+			}
+			prices[day] = p
+		}
+
+		price, start, err := omiePeriod(prices[day], day, r.Time)
+		if err != nil {
+			acc.AddError(fmt.Errorf("[omie]: %s", err))
+			continue
+		}
+		if periods[start] == nil {
+			periods[start] = &omiePeriodCost{price: price}
+		}
+		periods[start].kwh += r.Kwh
+		periods[start].cost += r.Kwh * (price/1000*eredes.OMIE.Factor + eredes.OMIE.Margin)
+	}
+
+	var times []time.Time
+	for start := range periods {
+		times = append(times, start)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	for _, start := range times {
+		fields := map[string]interface{}{
+			"kwh":           periods[start].kwh,
+			"price_eur_mwh": periods[start].price,
+			"cost_eur":      periods[start].cost,
+		}
+		acc.AddFields("eredes_omie", fields, eredes.cpeTags(cpe), start)
+	}
+}
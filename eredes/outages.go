@@ -0,0 +1,124 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/tidwall/gjson"
+)
+
+// Request the supply interruptions of the CPE range and emit them as
+// eredes_outages, one point at the start of each with its duration and a
+// cause tag. Fetched once a day.
+func (eredes *EREDES) gatherOutages(acc telegraf.Accumulator, s *session, token string, cpe string) error {
+	startDate, endDate := eredes.requestWindow(cpe)
+	start := startDate.Format("2006-01-02 15:04:05")
+	end := endDate.Format("2006-01-02 15:04:05")
+
+	body := `{"cpe": "` + cpe + `","start_date":"` + start + `","end_date":"` + end + `"}`
+
+	log.Printf("[eredes] requesting outages of %s", cpe)
+	response, err := s.makeRequest(eredes.outagesURL(), body, token)
+	if err != nil {
+		return err
+	}
+
+	outages := gjson.GetBytes(response, eredes.OutagesPath)
+	if !outages.Exists() {
+		return fmt.Errorf("no outages in %q", eredes.OutagesPath)
+	}
+
+	for _, outage := range outages.Array() {
+		outageStart, err := time.ParseInLocation("2006-01-02 15:04:05", outage.Get("startDate").String(), eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid outage start date: %s", err)
+		}
+
+		fields := map[string]interface{}{}
+		if outageEnd, err := time.ParseInLocation("2006-01-02 15:04:05", outage.Get("endDate").String(), eredes.location); err == nil {
+			fields["duration_s"] = int64(outageEnd.Sub(outageStart).Seconds())
+			fields["end"] = outageEnd.Unix()
+		} else if duration := outage.Get("duration"); duration.Exists() {
+			fields["duration_s"] = duration.Int()
+		} else {
+			// Still going on
+			fields["ongoing"] = true
+		}
+
+		tags := eredes.cpeTags(cpe)
+		if cause := outage.Get("causeCode").String(); cause != "" {
+			tags["cause"] = cause
+		}
+		acc.AddFields("eredes_outages", fields, tags, outageStart)
+	}
+	s.outagesFetched.done(cpe)
+
+	log.Printf("[eredes] added %d outages of %s", len(outages.Array()), cpe)
+	return nil
+}
+
+func (eredes *EREDES) outagesURL() string {
+	if eredes.OutagesURL == "" {
+		return eredesOutages
+	}
+	return eredes.OutagesURL
+}
+
+// Days ahead of the planned interruptions requested
+const plannedOutagesDays = 30
+
+// Request the announced interruptions of the next days and emit them as
+// eredes_planned_outages, dated at their future start, with description and
+// window tags. Fetched once a day.
+func (eredes *EREDES) gatherPlannedOutages(acc telegraf.Accumulator, s *session, token string, cpe string) error {
+	start := time.Now().In(eredes.location)
+	end := start.AddDate(0, 0, plannedOutagesDays)
+
+	body := `{"cpe": "` + cpe + `","start_date":"` + start.Format("2006-01-02 15:04:05") + `","end_date":"` + end.Format("2006-01-02 15:04:05") + `"}`
+
+	log.Printf("[eredes] requesting planned outages of %s", cpe)
+	response, err := s.makeRequest(eredes.plannedOutagesURL(), body, token)
+	if err != nil {
+		return err
+	}
+
+	outages := gjson.GetBytes(response, eredes.PlannedOutagesPath)
+	if !outages.Exists() {
+		return fmt.Errorf("no planned outages in %q", eredes.PlannedOutagesPath)
+	}
+
+	for _, outage := range outages.Array() {
+		outageStart, err := time.ParseInLocation("2006-01-02 15:04:05", outage.Get("startDate").String(), eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid planned outage start date: %s", err)
+		}
+		outageEnd, err := time.ParseInLocation("2006-01-02 15:04:05", outage.Get("endDate").String(), eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid planned outage end date: %s", err)
+		}
+
+		tags := eredes.cpeTags(cpe)
+		tags["window"] = outageStart.Format("2006-01-02 15:04") + " - " + outageEnd.Format("2006-01-02 15:04")
+		if description := outage.Get("description").String(); description != "" {
+			tags["description"] = description
+		}
+		fields := map[string]interface{}{
+			"duration_s": int64(outageEnd.Sub(outageStart).Seconds()),
+			"end":        outageEnd.Unix(),
+		}
+		acc.AddFields("eredes_planned_outages", fields, tags, outageStart)
+	}
+	s.plannedOutagesFetched.done(cpe)
+
+	log.Printf("[eredes] added %d planned outages of %s", len(outages.Array()), cpe)
+	return nil
+}
+
+func (eredes *EREDES) plannedOutagesURL() string {
+	if eredes.PlannedOutagesURL == "" {
+		return eredesPlannedOutages
+	}
+	return eredes.PlannedOutagesURL
+}
@@ -0,0 +1,52 @@
+package eredes
+
+import (
+	"fmt"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Fields of the phases of a three-phase supply point, in phase_keys order
+var phaseFields = []string{"l1", "l2", "l3"}
+
+// Remove the per-phase values of a parsed reading, fields phase_keys, and
+// return them as l1, l2 and l3.
+// Converted to kWh with unit = "kwh" like the other fields.
+func (eredes *EREDES) takePhases(metric telegraf.Metric) map[string]interface{} {
+	var phases map[string]interface{}
+	for i, key := range eredes.PhaseKeys {
+		value, ok := metric.GetField(key)
+		if !ok {
+			continue
+		}
+		metric.RemoveField(key)
+
+		v, ok := toFloat(value)
+		if !ok {
+			continue
+		}
+		if eredes.Unit == "kwh" {
+			v /= 1000
+		}
+		if phases == nil {
+			phases = make(map[string]interface{})
+		}
+		phases[phaseFields[i]] = v
+	}
+	return phases
+}
+
+// Tells if a field of the parsed readings is a phase_keys one
+func (eredes *EREDES) isPhaseKey(key string) bool {
+	return contains(eredes.PhaseKeys, key)
+}
+
+func (eredes *EREDES) initPhases() error {
+	if eredes.PhaseKeys == nil {
+		eredes.PhaseKeys = []string{"meterLoadCurveL1", "meterLoadCurveL2", "meterLoadCurveL3"}
+	}
+	if len(eredes.PhaseKeys) != 0 && len(eredes.PhaseKeys) != len(phaseFields) {
+		return fmt.Errorf("phase_keys needs the keys of l1, l2 and l3, got %d", len(eredes.PhaseKeys))
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package eredes
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/influxdata/telegraf"
+)
+
+// PostProcessor is a step of the chain applied, in order, to the readings
+// before they're emitted. Meant for older meters with noisy or glitchy
+// load curves.
+type PostProcessor struct {
+	// median, clamp or scale
+	Type string `toml:"type"`
+
+	// Fields to process, all numeric fields if empty
+	Fields []string `toml:"fields"`
+
+	// median: number of readings in the sliding window
+	Window int `toml:"window"`
+
+	// clamp: range the values are limited to, either bound can be left out
+	Min *float64 `toml:"min"`
+	Max *float64 `toml:"max"`
+
+	// scale: value multiplier (ex: 0.001 to fix Wh reported as kWh).
+	// Integer fields keep their type, so they're rounded.
+	Factor float64 `toml:"factor"`
+}
+
+func (p *PostProcessor) init() error {
+	switch p.Type {
+	case "median":
+		if p.Window == 0 {
+			p.Window = 3
+		}
+		if p.Window < 1 {
+			return fmt.Errorf("post_processor median: window must be positive")
+		}
+	case "clamp":
+		if p.Min == nil && p.Max == nil {
+			return fmt.Errorf("post_processor clamp: min or max is required")
+		}
+		if p.Min != nil && p.Max != nil && *p.Max <= *p.Min {
+			return fmt.Errorf("post_processor clamp: max must be greater than min")
+		}
+	case "scale":
+		if p.Factor == 0 {
+			return fmt.Errorf("post_processor scale: factor is required")
+		}
+	default:
+		return fmt.Errorf("unknown post_processor type %q", p.Type)
+	}
+	return nil
+}
+
+// Apply the post processors to the readings, sorted by time
+func (eredes *EREDES) postProcess(metrics []telegraf.Metric) {
+	if len(eredes.PostProcessors) == 0 {
+		return
+	}
+
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Time().Before(metrics[j].Time())
+	})
+
+	for _, p := range eredes.PostProcessors {
+		for _, field := range p.fields(metrics) {
+			values := make([]float64, len(metrics))
+			present := make([]bool, len(metrics))
+			for i, metric := range metrics {
+				if raw, ok := metric.GetField(field); ok {
+					values[i], present[i] = toFloat(raw)
+				}
+			}
+
+			processed := p.apply(values, present)
+
+			for i, metric := range metrics {
+				if present[i] {
+					setFloatField(metric, field, processed[i])
+				}
+			}
+		}
+	}
+}
+
+// Fields the processor applies to
+func (p *PostProcessor) fields(metrics []telegraf.Metric) []string {
+	if len(p.Fields) > 0 {
+		return p.Fields
+	}
+
+	seen := make(map[string]bool)
+	var fields []string
+	for _, metric := range metrics {
+		for _, field := range metric.FieldList() {
+			if _, ok := toFloat(field.Value); ok && !seen[field.Key] {
+				seen[field.Key] = true
+				fields = append(fields, field.Key)
+			}
+		}
+	}
+	return fields
+}
+
+func (p *PostProcessor) apply(values []float64, present []bool) []float64 {
+	processed := make([]float64, len(values))
+	for i, value := range values {
+		if !present[i] {
+			continue
+		}
+
+		switch p.Type {
+		case "median":
+			// Only full windows, so a spike next to the edges isn't spread
+			// into the readings there, which are kept as they are
+			var window []float64
+			for j := i - p.Window/2; j <= i+(p.Window-1)/2; j++ {
+				if j >= 0 && j < len(values) && present[j] {
+					window = append(window, values[j])
+				}
+			}
+			processed[i] = value
+			if len(window) == p.Window {
+				processed[i] = median(window)
+			}
+		case "clamp":
+			processed[i] = value
+			if p.Min != nil && value < *p.Min {
+				processed[i] = *p.Min
+			} else if p.Max != nil && value > *p.Max {
+				processed[i] = *p.Max
+			}
+		case "scale":
+			processed[i] = value * p.Factor
+		}
+	}
+	return processed
+}
+
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// Set a field keeping its type, parsers usually keep the values as strings
+func setFloatField(metric telegraf.Metric, field string, value float64) {
+	raw, _ := metric.GetField(field)
+	switch raw.(type) {
+	case string:
+		metric.AddField(field, strconv.FormatFloat(value, 'f', -1, 64))
+	case int64:
+		metric.AddField(field, int64(math.Round(value)))
+	case uint64:
+		metric.AddField(field, uint64(math.Round(value)))
+	default:
+		metric.AddField(field, value)
+	}
+}
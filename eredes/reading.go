@@ -0,0 +1,213 @@
+package eredes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// Version of the serialized Reading, bumped on incompatible changes
+const readingVersion = 1
+
+// Reading is the plugin's model of a meter reading, whatever the parser or
+// the portal response looked like. Subsystems (snapshot, state, exporters)
+// work on readings instead of the raw response.
+type Reading struct {
+	Cpe  string
+	Time time.Time
+
+	// Energy of the period, sum of the numeric fields of the parsed metric
+	Kwh float64
+
+	// consumption or injection
+	Direction string
+	// Meter register (ex: vazio, ponta, cheias), empty for load curves
+	Register string
+	// Portal quality flag (ex: real, estimated), empty if unknown
+	Quality string
+	// How the reading was taken (ex: telemetry, manual), empty if unknown
+	Source string
+	// Period the reading covers
+	Resolution time.Duration
+}
+
+// Serialized form, versioned so stored readings can still be read after the
+// model changes
+type readingJSON struct {
+	Version    int       `json:"v"`
+	Cpe        string    `json:"cpe"`
+	Time       time.Time `json:"ts"`
+	Kwh        float64   `json:"kwh"`
+	Direction  string    `json:"direction,omitempty"`
+	Register   string    `json:"register,omitempty"`
+	Quality    string    `json:"quality,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Resolution string    `json:"resolution,omitempty"`
+}
+
+// MarshalJSON serializes the reading with the current version
+func (r Reading) MarshalJSON() ([]byte, error) {
+	j := readingJSON{
+		Version:   readingVersion,
+		Cpe:       r.Cpe,
+		Time:      r.Time,
+		Kwh:       r.Kwh,
+		Direction: r.Direction,
+		Register:  r.Register,
+		Quality:   r.Quality,
+		Source:    r.Source,
+	}
+	if r.Resolution != 0 {
+		j.Resolution = r.Resolution.String()
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON reads a serialized reading, rejecting unknown versions
+func (r *Reading) UnmarshalJSON(b []byte) error {
+	var j readingJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Version != readingVersion {
+		return fmt.Errorf("unsupported reading version %d", j.Version)
+	}
+
+	*r = Reading{
+		Cpe:       j.Cpe,
+		Time:      j.Time,
+		Kwh:       j.Kwh,
+		Direction: j.Direction,
+		Register:  j.Register,
+		Quality:   j.Quality,
+		Source:    j.Source,
+	}
+	if j.Resolution != "" {
+		resolution, err := time.ParseDuration(j.Resolution)
+		if err != nil {
+			return fmt.Errorf("invalid reading resolution: %s", err)
+		}
+		r.Resolution = resolution
+	}
+	return nil
+}
+
+// Quality flag values of the portal, anything else is kept as is
+var qualities = map[string]string{
+	"r":         "real",
+	"real":      "real",
+	"measured":  "real",
+	"e":         "estimated",
+	"estimated": "estimated",
+	"estimada":  "estimated",
+	"estimado":  "estimated",
+}
+
+// Source values of the portal, anything else is kept as is
+var sources = map[string]string{
+	"t":            "telemetry",
+	"telemetry":    "telemetry",
+	"telecontagem": "telemetry",
+	"remota":       "telemetry",
+	"m":            "manual",
+	"manual":       "manual",
+	"cliente":      "manual",
+	"autoleitura":  "manual",
+}
+
+// Remove the quality flag of a parsed reading, field or tag quality_key,
+// and return it as real or estimated. Empty if the reading has none.
+func (eredes *EREDES) takeQuality(metric telegraf.Metric) string {
+	if quality := takeFlag(metric, eredes.QualityKey, qualities); quality != "" {
+		return quality
+	}
+	// Readings of transform_command have it as a tag
+	quality, _ := metric.GetTag("quality")
+	return quality
+}
+
+// Remove the source of a parsed reading, field or tag source_key, and
+// return it as telemetry or manual. Empty if the reading has none.
+func (eredes *EREDES) takeSource(metric telegraf.Metric) string {
+	if source := takeFlag(metric, eredes.SourceKey, sources); source != "" {
+		return source
+	}
+	source, _ := metric.GetTag("source")
+	return source
+}
+
+func takeFlag(metric telegraf.Metric, key string, values map[string]string) string {
+	if key == "" {
+		return ""
+	}
+
+	var raw string
+	if value, ok := metric.GetField(key); ok {
+		raw = fmt.Sprint(value)
+		metric.RemoveField(key)
+	} else if value, ok := metric.GetTag(key); ok {
+		raw = value
+		metric.RemoveTag(key)
+	}
+	if raw == "" {
+		return ""
+	}
+
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if value, ok := values[raw]; ok {
+		return value
+	}
+	return raw
+}
+
+// Tells if a field of the parsed readings is kept out of the reading
+// values: quality_key, source_key and phase_keys
+func (eredes *EREDES) bookkeepingKey(key string) bool {
+	return key == eredes.QualityKey || (key == eredes.SourceKey && key != "") || eredes.isPhaseKey(key)
+}
+
+// Period covered by the readings of the reading_type. Months vary, so
+// monthly readings have none.
+func (eredes *EREDES) readingResolution() time.Duration {
+	switch eredes.ReadingType {
+	case "daily":
+		return 24 * time.Hour
+	case "monthly":
+		return 0
+	}
+	return 15 * time.Minute
+}
+
+// A parsed reading with an empty consumption value, the portal has none for
+// its period
+var errEmptyReading = errors.New("empty reading")
+
+// Reading of a parsed metric, with the energy of its consumption field.
+// String values are parsed as the parsers usually keep the values as
+// strings. A reading without the field fails, so a parser not matching
+// consumption_field doesn't count zeros.
+func newReading(cpe string, metric telegraf.Metric, field string, resolution time.Duration) (Reading, error) {
+	r := Reading{
+		Cpe:        cpe,
+		Time:       metric.Time(),
+		Direction:  "consumption",
+		Resolution: resolution,
+	}
+	r.Register, _ = metric.GetTag("register")
+
+	value, ok := metric.GetField(field)
+	if !ok {
+		return r, fmt.Errorf("no %s field in the reading at %s, see consumption_field", field, r.Time.Format(time.RFC3339))
+	}
+	if value == "" {
+		return r, errEmptyReading
+	}
+	if r.Kwh, ok = toFloat(value); !ok {
+		return r, fmt.Errorf("%s field of the reading at %s isn't a number: %v", field, r.Time.Format(time.RFC3339), value)
+	}
+	return r, nil
+}
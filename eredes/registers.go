@@ -0,0 +1,165 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/tidwall/gjson"
+)
+
+// Request the cumulative meter register readings (totalizadores) of the CPE
+// range and emit them as eredes_register, one point per reading time with a
+// field per register (ex: vazio_kwh, ponta_kwh, cheias_kwh). The values only
+// grow, like the physical meter display. Fetched once a day. With
+// register_deltas each register also gets the consumption since its previous
+// reading (ex: vazio_delta_kwh).
+func (eredes *EREDES) gatherRegisters(acc telegraf.Accumulator, s *session, token string, cpe string) error {
+	startDate, endDate := eredes.requestWindow(cpe)
+	start := startDate.Format("2006-01-02 15:04:05")
+	end := endDate.Format("2006-01-02 15:04:05")
+
+	body := `{"cpe": "` + cpe + `","start_date":"` + start + `","end_date":"` + end + `"}`
+
+	log.Printf("[eredes] requesting register readings of %s", cpe)
+	response, err := s.makeRequest(eredes.registerReadingsURL(), body, token)
+	if err != nil {
+		return err
+	}
+
+	registers := gjson.GetBytes(response, eredes.RegisterReadingsPath)
+	if !registers.Exists() {
+		return fmt.Errorf("no register readings in %q", eredes.RegisterReadingsPath)
+	}
+
+	// Registers are listed one by one, grouped by the time they were read
+	var times []time.Time
+	fields := make(map[time.Time]map[string]interface{})
+	for _, register := range registers.Array() {
+		name := register.Get("register").String()
+		value := register.Get("value")
+		if name == "" || !value.Exists() {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", register.Get("timestamp").String(), eredes.location)
+		if err != nil {
+			return fmt.Errorf("invalid register reading timestamp: %s", err)
+		}
+		if fields[t] == nil {
+			fields[t] = make(map[string]interface{})
+			times = append(times, t)
+		}
+		fields[t][name+"_kwh"] = value.Float()
+	}
+
+	if eredes.RegisterDeltas {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for _, t := range times {
+			deltas := make(map[string]interface{})
+			for field, value := range fields[t] {
+				register := strings.TrimSuffix(field, "_kwh")
+				if delta, ok := eredes.registerDelta(cpe, register, value.(float64), t); ok {
+					deltas[register+"_delta_kwh"] = delta
+				}
+			}
+			for field, delta := range deltas {
+				fields[t][field] = delta
+			}
+		}
+	}
+
+	for _, t := range times {
+		acc.AddCounter("eredes_register", fields[t], eredes.cpeTags(cpe), t)
+	}
+	s.registersFetched.done(cpe)
+
+	log.Printf("[eredes] added %d register readings of %s", len(times), cpe)
+	return nil
+}
+
+// Last register readings of the current cycle. The registers are requested
+// from the watermark, so they're only committed to the state with it and a
+// range requested again gets the same deltas.
+type pendingRegisters struct {
+	sync.Mutex
+	counters map[string]counter
+}
+
+// Set the last reading of a register and return the previous one, starting
+// from committed. Returns false for a reading at or before the last one, or
+// for the first reading.
+func (p *pendingRegisters) set(cpe string, register string, committed counter, found bool, kwh float64, t time.Time) (counter, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.counters == nil {
+		p.counters = make(map[string]counter)
+	}
+	key := cpe + "/" + register
+	previous, ok := p.counters[key]
+	if !ok {
+		previous, ok = committed, found
+	}
+	if ok && !t.After(previous.Until) {
+		return previous, false
+	}
+	p.counters[key] = counter{Kwh: kwh, Until: t}
+	return previous, ok
+}
+
+// Returns and clears the last register readings of a CPE, per register
+func (p *pendingRegisters) take(cpe string) map[string]counter {
+	p.Lock()
+	defer p.Unlock()
+
+	registers := make(map[string]counter)
+	for key, c := range p.counters {
+		if register := strings.TrimPrefix(key, cpe+"/"); register != key {
+			registers[register] = c
+			delete(p.counters, key)
+		}
+	}
+	return registers
+}
+
+// Commit the last register readings of a CPE, once its window is committed
+func (eredes *EREDES) commitRegisters(cpe string) {
+	for register, c := range eredes.registers.take(cpe) {
+		eredes.state.setRegister(cpe, register, c)
+	}
+}
+
+// Consumption of a register since its previous reading. A register lower
+// than before rolled over when register_rollover is set and the delta is
+// under half of it, otherwise the meter was swapped and the reading only
+// starts the new baseline.
+func (eredes *EREDES) registerDelta(cpe string, register string, value float64, t time.Time) (float64, bool) {
+	committed, found := eredes.state.register(cpe, register)
+	previous, ok := eredes.registers.set(cpe, register, committed, found, value, t)
+	if !ok {
+		return 0, false
+	}
+
+	delta := value - previous.Kwh
+	if delta >= 0 {
+		return delta, true
+	}
+	if rollover := eredes.RegisterRollover; rollover > 0 && delta+rollover < rollover/2 {
+		return delta + rollover, true
+	}
+
+	log.Printf("[eredes] %s register %s went from %g to %g, assuming the meter was replaced", cpe, register, previous.Kwh, value)
+	return 0, false
+}
+
+func (eredes *EREDES) registerReadingsURL() string {
+	if eredes.RegisterReadingsURL == "" {
+		return eredesRegisterReadings
+	}
+	return eredes.RegisterReadingsURL
+}
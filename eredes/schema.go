@@ -0,0 +1,54 @@
+package eredes
+
+import (
+	"regexp"
+	"strings"
+)
+
+var entityIDInvalid = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Rename a reading to the schema, returning its measurement. With
+// home_assistant the reading is written like the Home Assistant InfluxDB
+// integration writes an energy sensor: a kWh measurement with the sensor
+// and entity_id tags and a value field. The value is the running total
+// (cumulative_counter) of the consumption, so it's a total_increasing
+// sensor the energy dashboard accepts; other directions keep their kwh.
+// Returns false for consumption readings already counted, they'd set the
+// sensor back.
+func (eredes *EREDES) applySchema(measurement string, tags map[string]string, fields map[string]interface{}) (string, bool) {
+	if eredes.Schema != "home_assistant" {
+		return measurement, true
+	}
+
+	value, stateClass := fields["kwh"], "measurement"
+	if total, ok := fields["consumption_total_kwh"]; ok {
+		value, stateClass = total, "total_increasing"
+	} else if d := tags["direction"] + tags["flow"]; d == "" || d == "consumption" {
+		return measurement, false
+	}
+	if value == nil {
+		return measurement, true
+	}
+
+	name := tags["name"]
+	if name == "" {
+		name = tags["cpe"]
+	}
+	parts := []string{"eredes", name}
+	if d := tags["direction"] + tags["flow"]; d != "" {
+		parts = append(parts, d)
+	}
+	objectID := entityIDInvalid.ReplaceAllString(strings.ToLower(strings.Join(parts, "_")), "_")
+
+	tags["domain"] = "sensor"
+	tags["entity_id"] = objectID
+	for k := range fields {
+		delete(fields, k)
+	}
+	fields["value"] = value
+	fields["state_class_str"] = stateClass
+	fields["device_class_str"] = "energy"
+	fields["unit_of_measurement_str"] = "kWh"
+	fields["friendly_name_str"] = strings.Join(parts[1:], " ")
+	return "kWh", true
+}
@@ -0,0 +1,128 @@
+package eredes
+
+import (
+	"net/http"
+	"time"
+)
+
+// Account is a set of credentials and the supply points gathered with them,
+// to monitor meters of several portal accounts from one plugin block
+type Account struct {
+	Username     string   `toml:"username"`
+	Password     string   `toml:"password"`
+	Cpes         []string `toml:"cpes"`
+	DiscoverCpes bool     `toml:"discover_cpes"`
+}
+
+// Portal session of an account. Sessions share nothing but the plugin
+// configuration, so an account failing doesn't affect the others.
+type session struct {
+	eredes *EREDES
+
+	// Identifies the account in logs, errors and the state file
+	name string
+
+	username string
+	password string
+	vault    *vaultCredentials
+
+	cpes     []string
+	discover bool
+
+	client        HTTPDoer
+	jar           *recordingJar
+	authenticator Authenticator
+	fetcher       UsageFetcher
+
+	// CPEs listed by the portal, refreshed daily
+	discoveredCpes []string
+	discoveredAt   time.Time
+
+	contracts              contracts
+	meters                 meters
+	dailyFetched           fetchTimes
+	maxPowerFetched        fetchTimes
+	monthlyFetched         fetchTimes
+	registersFetched       fetchTimes
+	outagesFetched         fetchTimes
+	plannedOutagesFetched  fetchTimes
+	contractHistoryFetched fetchTimes
+
+	// Consecutive failed sign in attempts, reported with the errors
+	signInAttempts int
+
+	// The portal requires the password of the account to be changed,
+	// reported in eredes_status
+	passwordExpired bool
+}
+
+func newSession(eredes *EREDES, name string, username string, password string, cpes []string, discover bool, transport http.RoundTripper) (*session, error) {
+	s := &session{
+		eredes:   eredes,
+		name:     name,
+		username: username,
+		password: password,
+		discover: discover,
+		client:   eredes.Client,
+	}
+
+	for _, cpe := range cpes {
+		if cpe != "" && !contains(s.cpes, cpe) {
+			s.cpes = append(s.cpes, cpe)
+		}
+	}
+
+	// Keep the session cookies set by the portal on sign in, they're
+	// expected on the following requests
+	jar, err := newRecordingJar()
+	if err != nil {
+		return nil, err
+	}
+	s.jar = jar
+
+	if s.client == nil {
+		s.client = &http.Client{
+			Transport: transport,
+			Timeout:   eredes.Timeout.Duration,
+			Jar:       jar,
+		}
+	}
+
+	s.authenticator = &passwordAuthenticator{session: s}
+	s.fetcher = &portalFetcher{session: s}
+
+	return s, nil
+}
+
+// Returns the configured credentials, or the ones stored in vault for the
+// top level account
+func (s *session) credentials() (string, string, error) {
+	if s.vault != nil {
+		return s.vault.get()
+	}
+	return s.username, s.password, nil
+}
+
+// Configured and discovered CPEs
+func (s *session) allCpes() []string {
+	cpes := append([]string{}, s.cpes...)
+	for _, cpe := range s.discoveredCpes {
+		if !contains(cpes, cpe) {
+			cpes = append(cpes, cpe)
+		}
+	}
+	return cpes
+}
+
+// CPEs of all the accounts
+func (eredes *EREDES) allCpes() []string {
+	var cpes []string
+	for _, s := range eredes.sessions {
+		for _, cpe := range s.allCpes() {
+			if !contains(cpes, cpe) {
+				cpes = append(cpes, cpe)
+			}
+		}
+	}
+	return cpes
+}
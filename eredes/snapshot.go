@@ -0,0 +1,233 @@
+package eredes
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Days of totals kept for the snapshot
+const snapshotDays = 31
+
+// Snapshot holds the latest aggregates of the plugin as plain values, for
+// applications embedding the plugin (ex: a small web UI)
+type Snapshot struct {
+	State      pluginState `json:"state"`
+	StateSince time.Time   `json:"state_since"`
+
+	// Last time Gather ran and last time it finished without errors
+	LastGather  time.Time `json:"last_gather"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// Timestamp of the newest reading and how far behind it is
+	LastReading time.Time     `json:"last_reading"`
+	Lag         time.Duration `json:"-"`
+
+	DailyTotals []DailyTotal `json:"daily_totals"`
+
+	// Readings dropped for being outside the requested window
+	DroppedReadings int64 `json:"dropped_readings"`
+
+	// Expiry and planned re-auth of the current token per account, if
+	// it's a JWT
+	Tokens map[string]TokenInfo `json:"tokens,omitempty"`
+
+	// Outcome of the last attempt per supply point
+	Cpes map[string]CpeStatus `json:"cpes,omitempty"`
+}
+
+// CpeStatus is the outcome of the last attempt of a supply point
+type CpeStatus struct {
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastReading time.Time `json:"last_reading"`
+}
+
+// DailyTotal is the sum of the readings of a supply point in a day
+type DailyTotal struct {
+	Cpe    string  `json:"cpe"`
+	Date   string  `json:"date"`
+	Total  float64 `json:"total"`
+	Points int     `json:"points"`
+}
+
+type snapshotter struct {
+	sync.Mutex
+
+	state      pluginState
+	stateSince time.Time
+
+	lastGather  time.Time
+	lastSuccess time.Time
+	lastError   string
+	lastReading time.Time
+	dropped     int64
+	tokens      map[string]TokenInfo
+	cpes        map[string]CpeStatus
+	// Reading values per day and timestamp, the same day is usually
+	// gathered more than once
+	readings map[dayKey]map[int64]float64
+}
+
+type dayKey struct {
+	cpe  string
+	date string
+}
+
+// Snapshot returns a copy of the latest aggregates. Safe to call while
+// Gather is running.
+func (eredes *EREDES) Snapshot() Snapshot {
+	s := &eredes.snapshot
+	s.Lock()
+	defer s.Unlock()
+
+	snapshot := Snapshot{
+		State:       s.state,
+		StateSince:  s.stateSince,
+		LastGather:  s.lastGather,
+		LastSuccess: s.lastSuccess,
+		LastError:   s.lastError,
+		LastReading: s.lastReading,
+
+		DroppedReadings: s.dropped,
+	}
+
+	if len(s.tokens) > 0 {
+		snapshot.Tokens = make(map[string]TokenInfo, len(s.tokens))
+		for account, info := range s.tokens {
+			snapshot.Tokens[account] = info
+		}
+	}
+	if len(s.cpes) > 0 {
+		snapshot.Cpes = make(map[string]CpeStatus, len(s.cpes))
+		for cpe, status := range s.cpes {
+			snapshot.Cpes[cpe] = status
+		}
+	}
+	if !s.lastReading.IsZero() {
+		snapshot.Lag = time.Since(s.lastReading)
+	}
+
+	for key, values := range s.readings {
+		total := DailyTotal{Cpe: key.cpe, Date: key.date, Points: len(values)}
+		for _, value := range values {
+			total.Total += value
+		}
+		snapshot.DailyTotals = append(snapshot.DailyTotals, total)
+	}
+	sort.Slice(snapshot.DailyTotals, func(i, j int) bool {
+		if snapshot.DailyTotals[i].Date != snapshot.DailyTotals[j].Date {
+			return snapshot.DailyTotals[i].Date < snapshot.DailyTotals[j].Date
+		}
+		return snapshot.DailyTotals[i].Cpe < snapshot.DailyTotals[j].Cpe
+	})
+
+	return snapshot
+}
+
+// Record the outcome of a gather cycle
+func (s *snapshotter) recordGather(err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastGather = time.Now()
+	if err != nil {
+		s.lastError = err.Error()
+		return
+	}
+	s.lastSuccess = s.lastGather
+	s.lastError = ""
+}
+
+// Record the outcome of the last attempt of a supply point
+func (s *snapshotter) recordCpe(cpe string, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.cpes == nil {
+		s.cpes = make(map[string]CpeStatus)
+	}
+	status := s.cpes[cpe]
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastSuccess = time.Now()
+		status.LastError = ""
+	}
+	s.cpes[cpe] = status
+}
+
+// Add a reading to the daily totals, replacing the previous value of the
+// same timestamp
+func (s *snapshotter) recordReading(r Reading) {
+	s.Lock()
+	defer s.Unlock()
+
+	if r.Time.After(s.lastReading) {
+		s.lastReading = r.Time
+	}
+	if s.cpes == nil {
+		s.cpes = make(map[string]CpeStatus)
+	}
+	if status := s.cpes[r.Cpe]; r.Time.After(status.LastReading) {
+		status.LastReading = r.Time
+		s.cpes[r.Cpe] = status
+	}
+
+	if s.readings == nil {
+		s.readings = make(map[dayKey]map[int64]float64)
+	}
+
+	key := dayKey{cpe: r.Cpe, date: r.Time.Format("2006-01-02")}
+	if s.readings[key] == nil {
+		s.readings[key] = make(map[int64]float64)
+	}
+	s.readings[key][r.Time.Unix()] = r.Kwh
+
+	oldest := time.Now().AddDate(0, 0, -snapshotDays).Format("2006-01-02")
+	for k := range s.readings {
+		if k.date < oldest {
+			delete(s.readings, k)
+		}
+	}
+}
+
+// Record the current token details of an account, nil if unknown
+func (s *snapshotter) recordToken(account string, info *TokenInfo) {
+	s.Lock()
+	defer s.Unlock()
+
+	if info == nil {
+		delete(s.tokens, account)
+		return
+	}
+	if s.tokens == nil {
+		s.tokens = make(map[string]TokenInfo)
+	}
+	s.tokens[account] = *info
+}
+
+// Count readings dropped for being outside the requested window
+func (s *snapshotter) recordDropped(n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.dropped += int64(n)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
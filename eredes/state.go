@@ -0,0 +1,344 @@
+package eredes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Plugin state persisted between Telegraf restarts
+type state struct {
+	// Supply points are gathered concurrently
+	lock sync.Mutex
+
+	// End of the last successfully gathered window, per CPE
+	Watermarks map[string]time.Time `json:"watermarks"`
+
+	// Last sign in attempt per account, so restarts don't bypass
+	// min_login_interval
+	LastLogins map[string]time.Time `json:"last_logins"`
+
+	// Fingerprint of the credentials the portal reported as expired, per
+	// account
+	ExpiredCredentials map[string]string `json:"expired_credentials"`
+
+	// Running consumption total per CPE, for cumulative_counter
+	Totals map[string]counter `json:"totals"`
+
+	// Last register reading per CPE and register, for register_deltas
+	Registers map[string]counter `json:"registers"`
+
+	// Newest reading emitted per CPE and direction, for skip_emitted
+	Emitted map[string]time.Time `json:"emitted"`
+
+	// Async usage jobs still running per request, to resume polling them
+	// after a restart
+	Jobs map[string]asyncJob `json:"jobs"`
+
+	// Consumption per CPE and day of the last weeks, for the weekly totals
+	// of aggregates
+	DayTotals map[string]map[string]dayTotal `json:"day_totals"`
+
+	// Portal requests made on the day, for max_daily_requests
+	RequestsDate string `json:"requests_date"`
+	Requests     int    `json:"requests"`
+}
+
+func newState() *state {
+	return &state{
+		Watermarks:         make(map[string]time.Time),
+		LastLogins:         make(map[string]time.Time),
+		ExpiredCredentials: make(map[string]string),
+		Totals:             make(map[string]counter),
+		Registers:          make(map[string]counter),
+		Emitted:            make(map[string]time.Time),
+		Jobs:               make(map[string]asyncJob),
+		DayTotals:          make(map[string]map[string]dayTotal),
+	}
+}
+
+// Load the state from file. A missing file is not an error, the plugin just
+// starts without any watermark.
+func loadState(path string) (*state, error) {
+	s := newState()
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Watermarks == nil {
+		s.Watermarks = make(map[string]time.Time)
+	}
+	if s.LastLogins == nil {
+		s.LastLogins = make(map[string]time.Time)
+	}
+	if s.ExpiredCredentials == nil {
+		s.ExpiredCredentials = make(map[string]string)
+	}
+	if s.Totals == nil {
+		s.Totals = make(map[string]counter)
+	}
+	if s.Registers == nil {
+		s.Registers = make(map[string]counter)
+	}
+	if s.Emitted == nil {
+		s.Emitted = make(map[string]time.Time)
+	}
+	if s.Jobs == nil {
+		s.Jobs = make(map[string]asyncJob)
+	}
+	if s.DayTotals == nil {
+		s.DayTotals = make(map[string]map[string]dayTotal)
+	}
+
+	return s, nil
+}
+
+// Returns the end of the last gathered window of a CPE
+func (s *state) watermark(cpe string) (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	watermark, ok := s.Watermarks[cpe]
+	return watermark, ok
+}
+
+// Set the end of the last gathered window of a CPE and save the state
+func (s *state) setWatermark(cpe string, watermark time.Time, path string) error {
+	s.lock.Lock()
+	s.Watermarks[cpe] = watermark
+	s.lock.Unlock()
+
+	return s.save(path)
+}
+
+// Returns the last sign in attempt of an account
+func (s *state) lastLogin(account string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.LastLogins[account]
+}
+
+// Set the last sign in attempt of an account and save the state
+func (s *state) setLastLogin(account string, t time.Time, path string) error {
+	s.lock.Lock()
+	s.LastLogins[account] = t
+	s.lock.Unlock()
+
+	return s.save(path)
+}
+
+// Returns the fingerprint of the expired credentials of an account
+func (s *state) expiredCredentials(account string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fingerprint, ok := s.ExpiredCredentials[account]
+	return fingerprint, ok
+}
+
+// Set the fingerprint of the expired credentials of an account, empty to
+// clear it, and save the state
+func (s *state) setExpiredCredentials(account string, fingerprint string, path string) error {
+	s.lock.Lock()
+	if fingerprint == "" {
+		delete(s.ExpiredCredentials, account)
+	} else {
+		s.ExpiredCredentials[account] = fingerprint
+	}
+	s.lock.Unlock()
+
+	return s.save(path)
+}
+
+// Returns the running total of a CPE
+func (s *state) total(cpe string) counter {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Totals[cpe]
+}
+
+// Set the running total of a CPE, saved with the watermark
+func (s *state) setTotal(cpe string, c counter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Totals[cpe] = c
+}
+
+// Returns the last reading of a register, false for none yet
+func (s *state) register(cpe string, register string) (counter, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, ok := s.Registers[cpe+"/"+register]
+	return c, ok
+}
+
+// Set the last reading of a register, saved with the watermark
+func (s *state) setRegister(cpe string, register string, c counter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.Registers[cpe+"/"+register] = c
+}
+
+// Returns the newest reading emitted of a CPE and direction
+func (s *state) emitted(cpe string, direction string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Emitted[cpe+"/"+direction]
+}
+
+// Set the newest reading emitted of a CPE and direction, saved with the
+// watermark
+func (s *state) setEmitted(cpe string, direction string, t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if key := cpe + "/" + direction; t.After(s.Emitted[key]) {
+		s.Emitted[key] = t
+	}
+}
+
+// Returns the async job of a request, if it's recent enough to still be
+// polled
+func (s *state) job(request string) (asyncJob, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	job, ok := s.Jobs[request]
+	if !ok || time.Since(job.Submitted) > asyncJobMaxAge {
+		return asyncJob{}, false
+	}
+	return job, true
+}
+
+// Set the async job of a request, an empty ID clears it, and save the
+// state. Jobs too old to be polled are dropped.
+func (s *state) setJob(request string, job asyncJob, path string) error {
+	s.lock.Lock()
+	if job.ID == "" {
+		delete(s.Jobs, request)
+	} else {
+		s.Jobs[request] = job
+	}
+	for request, job := range s.Jobs {
+		if time.Since(job.Submitted) > asyncJobMaxAge {
+			delete(s.Jobs, request)
+		}
+	}
+	s.lock.Unlock()
+
+	return s.save(path)
+}
+
+// Returns the consumption per day of a CPE
+func (s *state) dayTotals(cpe string) map[string]dayTotal {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	totals := make(map[string]dayTotal)
+	for date, total := range s.DayTotals[cpe] {
+		totals[date] = total
+	}
+	return totals
+}
+
+// Set the consumption of days of a CPE, forget the days before oldest and
+// save the state
+func (s *state) setDayTotals(cpe string, totals map[string]dayTotal, oldest string, path string) error {
+	s.lock.Lock()
+	if s.DayTotals[cpe] == nil {
+		s.DayTotals[cpe] = make(map[string]dayTotal)
+	}
+	for date, total := range totals {
+		s.DayTotals[cpe][date] = total
+	}
+	for date := range s.DayTotals[cpe] {
+		if date < oldest {
+			delete(s.DayTotals[cpe], date)
+		}
+	}
+	s.lock.Unlock()
+
+	return s.save(path)
+}
+
+// Count a portal request of today
+func (s *state) countRequest() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	today := time.Now().Format("2006-01-02")
+	if s.RequestsDate != today {
+		s.RequestsDate = today
+		s.Requests = 0
+	}
+	s.Requests++
+}
+
+// Portal requests made today
+func (s *state) requestsToday() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.RequestsDate != time.Now().Format("2006-01-02") {
+		return 0
+	}
+	return s.Requests
+}
+
+// Save the state to file, writing to a temporary file first so a crash
+// mid-write doesn't leave a truncated state behind
+func (s *state) save(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, b)
+}
+
+// Write a file through a temporary file renamed over it, so a crash
+// mid-write leaves the previous content. Readable only by the owner.
+func writeFile(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,105 @@
+package eredes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// State of the plugin, reported in the eredes_status metric and the health
+// endpoint
+type pluginState string
+
+const (
+	stateStarting       pluginState = "starting"
+	stateAuthenticating pluginState = "authenticating"
+	stateGathering      pluginState = "gathering"
+	stateBackfilling    pluginState = "backfilling"
+	stateIdle           pluginState = "idle"
+	// Last cycle failed, next cycle retries
+	stateRetrying pluginState = "retrying"
+	// Requests aren't attempted (ex: password expired) until something changes
+	stateCircuitOpen pluginState = "circuit_open"
+)
+
+func (s *snapshotter) setState(state pluginState) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.state != state {
+		log.Printf("[eredes] state %s -> %s", s.state, state)
+		s.state = state
+		s.stateSince = time.Now()
+	}
+}
+
+// State after a gather cycle
+func stateAfter(err error) pluginState {
+	switch {
+	case err == nil:
+		return stateIdle
+	case errors.Is(err, errPasswordExpired):
+		return stateCircuitOpen
+	default:
+		return stateRetrying
+	}
+}
+
+// Emit the plugin state per CPE, so `telegraf --test` and outputs.health
+// can check it. The status is the one of the CPE account.
+func (eredes *EREDES) addStatus(acc telegraf.Accumulator) {
+	snapshot := eredes.Snapshot()
+
+	fields := map[string]interface{}{
+		"state":   string(snapshot.State),
+		"healthy": snapshot.Healthy(),
+
+		"dropped_readings": snapshot.DroppedReadings,
+	}
+	if !snapshot.LastSuccess.IsZero() {
+		fields["last_success"] = snapshot.LastSuccess.Unix()
+	}
+
+	emitted := make(map[string]bool)
+	for _, s := range eredes.sessions {
+		status := fields
+		if s.passwordExpired {
+			status = make(map[string]interface{}, len(fields)+1)
+			for k, v := range fields {
+				status[k] = v
+			}
+			status["status"] = "password_expired"
+		}
+
+		for _, cpe := range s.allCpes() {
+			if !emitted[cpe] {
+				emitted[cpe] = true
+				acc.AddFields("eredes_status", status, eredes.cpeTags(cpe))
+			}
+		}
+	}
+}
+
+// Healthy tells if the last cycle finished without errors
+func (s Snapshot) Healthy() bool {
+	return s.LastError == "" && s.State != stateCircuitOpen
+}
+
+// Probe checks the plugin can sign in to every account, for Telegraf
+// versions that probe plugins on startup (startup_error_behavior = "probe").
+// Telegraf 1.17 has no such interface and never calls it, there it's a
+// no-op and the first Gather reports sign in errors.
+func (eredes *EREDES) Probe() error {
+	eredes.snapshot.setState(stateAuthenticating)
+	for _, s := range eredes.sessions {
+		if _, err := s.authenticator.SignIn(); err != nil {
+			eredes.snapshot.setState(stateAfter(err))
+			return fmt.Errorf("account %s: %w", s.name, err)
+		}
+	}
+	eredes.snapshot.setState(stateIdle)
+	return nil
+}
@@ -0,0 +1,163 @@
+package eredes
+
+//go:generate go run gen_tariffs.go -source tariffs.csv -output tariffs_data.go
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval of a tariff cycle schedule, from the ERSE tariff period
+// definitions. Times are minutes of the day in Portuguese legal time.
+type tariffInterval struct {
+	// daily or weekly
+	cycle string
+	// winter, summer or all
+	season string
+	// all, weekdays, saturday or sunday
+	days   string
+	start  int
+	end    int
+	period string
+}
+
+// Load the tariff schedules from tariff_schedule_file, replacing the built
+// in ones, so an ERSE update can be applied without a new release. Same
+// format as tariffs.csv.
+func loadTariffSchedules(path string) ([]tariffInterval, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseTariffSchedules(f)
+}
+
+func parseTariffSchedules(r io.Reader) ([]tariffInterval, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("no tariff schedules")
+	}
+
+	var intervals []tariffInterval
+	for i, record := range records[1:] {
+		if len(record) != 6 {
+			return nil, fmt.Errorf("line %d: expected cycle,season,days,start,end,period", i+2)
+		}
+		start, err := parseMinutes(record[3])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+2, err)
+		}
+		end, err := parseMinutes(record[4])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+2, err)
+		}
+		intervals = append(intervals, tariffInterval{
+			cycle:  record[0],
+			season: record[1],
+			days:   record[2],
+			start:  start,
+			end:    end,
+			period: record[5],
+		})
+	}
+	return intervals, nil
+}
+
+// Minutes of the day of a HH:MM time, 24:00 being the end of the day
+func parseMinutes(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || hours > 24 || minutes > 59 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+var lisbon = mustLoadLocation("Europe/Lisbon")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		// No tz database, Portugal is UTC in winter
+		return time.UTC
+	}
+	return loc
+}
+
+// Tariff period (vazio, cheias or ponta) of a time in a cycle, empty if the
+// schedules don't cover it
+func tariffPeriod(intervals []tariffInterval, cycle string, t time.Time) string {
+	t = t.In(lisbon)
+
+	// Summer is legal time, when the offset is ahead of January's
+	_, offset := t.Zone()
+	_, winterOffset := time.Date(t.Year(), 1, 1, 12, 0, 0, 0, lisbon).Zone()
+	season := "winter"
+	if offset > winterOffset {
+		season = "summer"
+	}
+
+	days := "weekdays"
+	switch t.Weekday() {
+	case time.Saturday:
+		days = "saturday"
+	case time.Sunday:
+		days = "sunday"
+	}
+	if holiday(t) {
+		days = "sunday"
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, i := range intervals {
+		if i.cycle != cycle || (i.season != "all" && i.season != season) || (i.days != "all" && i.days != days) {
+			continue
+		}
+		if minute >= i.start && minute < i.end {
+			return i.period
+		}
+	}
+	return ""
+}
+
+// Tariff cycle of a CPE, daily or weekly, empty if its readings aren't
+// classified
+func (eredes *EREDES) tariffCycle(cpe string) string {
+	if o, ok := eredes.overrides[cpe]; ok && o.TariffCycle != "" {
+		return o.TariffCycle
+	}
+	return eredes.TariffCycle
+}
+
+// Add the tariff_period tag to a reading of a CPE with a tariff cycle. Only
+// quarter-hour readings are classified, longer ones span several periods.
+func (eredes *EREDES) tagTariffPeriod(tags map[string]string, cpe string, t time.Time) {
+	cycle := eredes.tariffCycle(cpe)
+	if cycle == "" || eredes.ReadingType != "quarter_hourly" {
+		return
+	}
+	if period := tariffPeriod(eredes.tariffSchedules, cycle, t); period != "" {
+		tags["tariff_period"] = period
+	}
+}
+
+func validTariffCycle(cycle string) bool {
+	return cycle == "" || cycle == "daily" || cycle == "weekly"
+}
@@ -0,0 +1,94 @@
+package eredes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
+)
+
+// Runs transform_command with the raw usage response on stdin. It must write
+// a JSON array of readings (see Reading) to stdout. The command runs with an
+// empty environment in a temporary directory and is killed after
+// transform_timeout, with the processes it started; a failure only fails
+// the window being gathered. It's not a sandbox, the command runs as the
+// Telegraf user with its access to files and network.
+func (eredes *EREDES) transform(response []byte) ([]Reading, error) {
+	dir, err := ioutil.TempDir("", "eredes-transform")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(eredes.TransformCommand[0], eredes.TransformCommand[1:]...)
+	cmd.Dir = dir
+	cmd.Env = []string{}
+	cmd.Stdin = bytes.NewReader(response)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	// In its own process group, so a timeout also kills its children.
+	// Otherwise they'd keep stdout open and Wait would block on them.
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("transform_command: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(eredes.TransformTimeout.Duration)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, fmt.Errorf("transform_command: %s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	case <-timer.C:
+		killProcessGroup(cmd)
+		<-done
+		return nil, fmt.Errorf("transform_command timed out after %s", eredes.TransformTimeout.Duration)
+	}
+
+	var readings []Reading
+	if err := json.Unmarshal(stdout.Bytes(), &readings); err != nil {
+		return nil, fmt.Errorf("transform_command output: %s", err)
+	}
+	return readings, nil
+}
+
+// The readings of the transform command as metrics, so they go through the
+// same processing as the parsed ones. The register, quality and source are
+// kept as tags.
+func readingMetrics(readings []Reading) ([]telegraf.Metric, error) {
+	metrics := make([]telegraf.Metric, 0, len(readings))
+	for _, r := range readings {
+		tags := make(map[string]string)
+		if r.Register != "" {
+			tags["register"] = r.Register
+		}
+		if r.Quality != "" {
+			tags["quality"] = r.Quality
+		}
+		if r.Source != "" {
+			tags["source"] = r.Source
+		}
+
+		m, err := metric.New("eredes", tags, map[string]interface{}{"kwh": r.Kwh}, r.Time)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
@@ -0,0 +1,14 @@
+// +build windows
+
+package eredes
+
+import (
+	"os/exec"
+)
+
+// No process group on Windows, a timeout only kills the command
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
@@ -0,0 +1,40 @@
+package eredes
+
+import "fmt"
+
+// Flows of a self-consumption unit (UPAC) requested with upac, in order
+var upacFlows = []string{"produced", "self_consumed", "injected"}
+
+// request_type of the usage request per UPAC flow, unless set in
+// upac_request_types
+var upacRequestTypes = map[string]string{
+	"produced":      "5",
+	"self_consumed": "6",
+	"injected":      "4",
+}
+
+// Fill in the request types of the flows not configured
+func (eredes *EREDES) initUPAC() error {
+	for flow := range eredes.UPACRequestTypes {
+		if _, ok := upacRequestTypes[flow]; !ok {
+			return fmt.Errorf("invalid flow %q in upac_request_types, expected produced, self_consumed or injected", flow)
+		}
+	}
+
+	if eredes.UPACRequestTypes == nil {
+		eredes.UPACRequestTypes = make(map[string]string)
+	}
+	for flow, requestType := range upacRequestTypes {
+		if eredes.UPACRequestTypes[flow] == "" {
+			eredes.UPACRequestTypes[flow] = requestType
+		}
+	}
+	return nil
+}
+
+// Tells if the readings of a direction are a UPAC flow, tagged with flow
+// instead of direction
+func (eredes *EREDES) isFlow(direction string) bool {
+	_, ok := upacRequestTypes[direction]
+	return eredes.UPAC && ok
+}
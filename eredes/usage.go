@@ -0,0 +1,63 @@
+package eredes
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// UsageFetcher requests the readings of a supply point in a range, in the
+// given direction (consumption, injection or a UPAC flow), and returns the payload for
+// the parser or transform_command. With an Authenticator it's the adapter
+// of a portal API, windows, state and emission don't depend on it.
+type UsageFetcher interface {
+	FetchUsage(token string, cpe string, direction string, start time.Time, end time.Time) ([]byte, error)
+}
+
+// Default UsageFetcher, the usage endpoint of online.e-redes.pt
+type portalFetcher struct {
+	session *session
+}
+
+func (f *portalFetcher) FetchUsage(token string, cpe string, direction string, startDate time.Time, endDate time.Time) ([]byte, error) {
+	s := f.session
+	eredes := s.eredes
+
+	start := startDate.Format("2006-01-02 15:04:05")
+	end := endDate.Format("2006-01-02 15:04:05")
+
+	requestType := readingTypes[eredes.ReadingType]
+	if direction == "injection" {
+		requestType = eredes.InjectionRequestType
+	} else if eredes.isFlow(direction) {
+		requestType = eredes.UPACRequestTypes[direction]
+	}
+
+	var usagesRequestBody string = `{"cpe": "` + cpe + `", "request_type":"` + requestType + `","start_date":"` + start + `","end_date":"` + end + `","wait":` + strconv.FormatBool(!eredes.Async) + `,"formatted":` + strconv.FormatBool(eredes.Formatted) + `}`
+
+	// log.Printf("[eredes] request body: " + usagesRequestBody)
+
+	log.Printf("[eredes] requesting usages (%s)", direction)
+	var response []byte
+	var err error
+	if eredes.Async {
+		response, err = s.requestAsync(usagesRequestBody, token)
+	} else {
+		response, err = s.makeRequest(eredes.usageURL(), usagesRequestBody, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if eredes.Formatted {
+		readings := gjson.GetBytes(response, eredes.FormattedPath)
+		if !readings.Exists() {
+			return nil, fmt.Errorf("no formatted readings in %q", eredes.FormattedPath)
+		}
+		response = []byte(readings.Raw)
+	}
+	return response, nil
+}
@@ -0,0 +1,132 @@
+package eredes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Reads the portal credentials from a HashiCorp Vault KV secret, using a
+// token or AppRole auth. The secret is read again when its lease expires,
+// so a rotated password is picked up without restarting Telegraf.
+type vaultCredentials struct {
+	address     string
+	path        string
+	token       string
+	roleID      string
+	secretID    string
+	usernameKey string
+	passwordKey string
+
+	client *http.Client
+
+	// Token from the AppRole login, when not using a static token
+	loginToken        string
+	loginTokenExpires time.Time
+
+	username string
+	password string
+	expires  time.Time
+}
+
+// Returns the cached credentials, reading the secret again if the lease
+// expired
+func (v *vaultCredentials) get() (string, string, error) {
+	if v.username != "" && time.Now().Before(v.expires) {
+		return v.username, v.password, nil
+	}
+
+	token, err := v.authToken()
+	if err != nil {
+		return "", "", fmt.Errorf("vault login: %s", err)
+	}
+
+	response, err := v.request("GET", "/v1/"+strings.TrimPrefix(v.path, "/"), "", token)
+	if err != nil {
+		return "", "", fmt.Errorf("vault read %s: %s", v.path, err)
+	}
+
+	// KV v2 nests the secret in data.data, KV v1 has it directly in data
+	data := gjson.Get(response, "data.data")
+	if !data.Exists() {
+		data = gjson.Get(response, "data")
+	}
+
+	username := data.Get(v.usernameKey).String()
+	password := data.Get(v.passwordKey).String()
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("vault secret %s doesn't have the %q and %q keys", v.path, v.usernameKey, v.passwordKey)
+	}
+
+	// Without a lease (KV v2) the secret is read on every sign in
+	lease := time.Duration(gjson.Get(response, "lease_duration").Int()) * time.Second
+
+	v.username = username
+	v.password = password
+	v.expires = time.Now().Add(lease)
+
+	log.Printf("[eredes] credentials read from vault")
+	return v.username, v.password, nil
+}
+
+// Returns the static token or logs in with AppRole when the previous
+// login token expired
+func (v *vaultCredentials) authToken() (string, error) {
+	if v.token != "" {
+		return v.token, nil
+	}
+
+	if v.loginToken != "" && time.Now().Before(v.loginTokenExpires) {
+		return v.loginToken, nil
+	}
+
+	body := `{"role_id": "` + v.roleID + `", "secret_id": "` + v.secretID + `"}`
+	response, err := v.request("POST", "/v1/auth/approle/login", body, "")
+	if err != nil {
+		return "", err
+	}
+
+	token := gjson.Get(response, "auth.client_token").String()
+	if token == "" {
+		return "", fmt.Errorf("no client token in approle login response")
+	}
+	lease := time.Duration(gjson.Get(response, "auth.lease_duration").Int()) * time.Second
+
+	v.loginToken = token
+	v.loginTokenExpires = time.Now().Add(lease)
+
+	return v.loginToken, nil
+}
+
+func (v *vaultCredentials) request(method string, path string, body string, token string) (string, error) {
+	request, err := http.NewRequest(method, strings.TrimSuffix(v.address, "/")+path, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := v.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("received status code %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	return string(b), nil
+}